@@ -6,9 +6,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -19,6 +19,7 @@ import (
 	"github.com/buaazp/fasthttprouter"
 	"github.com/nu7hatch/gouuid"
 	logger "github.com/snail007/mini-logger"
+	"github.com/streadway/amqp"
 	"github.com/valyala/fasthttp"
 )
 
@@ -38,10 +39,21 @@ func apiMessageAdd(ctx *fasthttp.RequestCtx) {
 	IsNeedTokenS := string(ctx.QueryArgs().Peek("IsNeedToken"))
 	Mode := string(ctx.QueryArgs().Peek("Mode"))
 	Token := string(ctx.QueryArgs().Peek("Token"))
+	AllowIPs := splitList(string(ctx.QueryArgs().Peek("AllowIPs")))
+	DenyIPs := splitList(string(ctx.QueryArgs().Peek("DenyIPs")))
+	MaxBodyBytes, _ := strconv.ParseInt(string(ctx.QueryArgs().Peek("MaxBodyBytes")), 10, 64)
+	ContentTypes := splitList(string(ctx.QueryArgs().Peek("ContentTypes")))
+	IdempotencyWindow, _ := strconv.ParseInt(string(ctx.QueryArgs().Peek("IdempotencyWindow")), 10, 64)
+	MaxPriority, _ := strconv.Atoi(string(ctx.QueryArgs().Peek("MaxPriority")))
 	if Name == "" || DurableS == "" || IsNeedTokenS == "" {
 		response(ctx, "", errors.New("args required.10001"))
 		return
 	}
+	JSONSchema, err := parseSchemaArg(ctx)
+	if err != nil {
+		response(ctx, "", err)
+		return
+	}
 	if _, _, err := getMessage(Name); err == nil {
 		response(ctx, "", errors.New("message exists"))
 		return
@@ -54,14 +66,6 @@ func apiMessageAdd(ctx *fasthttp.RequestCtx) {
 	if IsNeedTokenS == "1" {
 		IsNeedToken = true
 	}
-	if IsNeedToken && Token == "" {
-		response(ctx, "", errors.New("message exists"))
-		return
-	}
-	if Mode != "fanout" && Mode != "topic" && Mode != "direct" {
-		response(ctx, "", errors.New("args required.10002"))
-		return
-	}
 	m := message{
 		Name:        Name,
 		Durable:     Durable,
@@ -70,8 +74,21 @@ func apiMessageAdd(ctx *fasthttp.RequestCtx) {
 		Token:       Token,
 		Comment:     Comment,
 		Consumers:   []consumer{},
+		AllowIPs:    AllowIPs,
+		DenyIPs:     DenyIPs,
+
+		MaxBodyBytes: MaxBodyBytes,
+		ContentTypes: ContentTypes,
+		JSONSchema:   JSONSchema,
+
+		IdempotencyWindow: IdempotencyWindow,
+		MaxPriority:       MaxPriority,
 	}
-	err := addMessage(m)
+	if err = validateMessage(m).err(); err != nil {
+		response(ctx, "", err)
+		return
+	}
+	err = addMessage(m)
 	if err == nil {
 		err = writeMessagesToFile(messages, cfg.GetString("consume.DataFile"))
 	}
@@ -92,7 +109,8 @@ func apiMessageUpdate(ctx *fasthttp.RequestCtx) {
 		response(ctx, "", errors.New("args required.10003"))
 		return
 	}
-	if _, _, err := getMessage(Name); err != nil {
+	msg, _, err := getMessage(Name)
+	if err != nil {
 		response(ctx, "", errors.New("message not found"))
 		return
 	}
@@ -103,14 +121,6 @@ func apiMessageUpdate(ctx *fasthttp.RequestCtx) {
 	IsNeedToken := false
 	if IsNeedTokenS == "1" {
 		IsNeedToken = true
-		if Token == "" {
-			response(ctx, "", errors.New("args required.10013"))
-			return
-		}
-	}
-	if Mode != "fanout" && Mode != "topic" && Mode != "direct" {
-		response(ctx, "", errors.New("args required.10004"))
-		return
 	}
 	m := message{
 		Name:        Name,
@@ -119,8 +129,56 @@ func apiMessageUpdate(ctx *fasthttp.RequestCtx) {
 		IsNeedToken: IsNeedToken,
 		Token:       Token,
 		Comment:     Comment,
+		Consumers:   msg.Consumers,
+		AllowIPs:    msg.AllowIPs,
+		DenyIPs:     msg.DenyIPs,
+		Tokens:      msg.Tokens,
+
+		MaxBodyBytes: msg.MaxBodyBytes,
+		ContentTypes: msg.ContentTypes,
+		JSONSchema:   msg.JSONSchema,
+		Bindings:     msg.Bindings,
+
+		ReplyConsumer: msg.ReplyConsumer,
+
+		IdempotencyWindow: msg.IdempotencyWindow,
+		MaxPriority:       msg.MaxPriority,
+	}
+	//keep ip lists when they are not set
+	if ctx.QueryArgs().Has("AllowIPs") {
+		m.AllowIPs = splitList(string(ctx.QueryArgs().Peek("AllowIPs")))
+	}
+	if ctx.QueryArgs().Has("DenyIPs") {
+		m.DenyIPs = splitList(string(ctx.QueryArgs().Peek("DenyIPs")))
+	}
+	if ctx.QueryArgs().Has("ReplyConsumer") {
+		m.ReplyConsumer = string(ctx.QueryArgs().Peek("ReplyConsumer"))
+	}
+	//keep payload limits when they are not set
+	if ctx.QueryArgs().Has("MaxBodyBytes") {
+		m.MaxBodyBytes, _ = strconv.ParseInt(string(ctx.QueryArgs().Peek("MaxBodyBytes")), 10, 64)
+	}
+	//queues are declared again when MaxPriority was changed
+	if ctx.QueryArgs().Has("MaxPriority") {
+		m.MaxPriority, _ = strconv.Atoi(string(ctx.QueryArgs().Peek("MaxPriority")))
+	}
+	if ctx.QueryArgs().Has("IdempotencyWindow") {
+		m.IdempotencyWindow, _ = strconv.ParseInt(string(ctx.QueryArgs().Peek("IdempotencyWindow")), 10, 64)
+	}
+	if ctx.QueryArgs().Has("ContentTypes") {
+		m.ContentTypes = splitList(string(ctx.QueryArgs().Peek("ContentTypes")))
+	}
+	if ctx.QueryArgs().Has("JSONSchema") {
+		if m.JSONSchema, err = parseSchemaArg(ctx); err != nil {
+			response(ctx, "", err)
+			return
+		}
 	}
-	err := updateMessage(m)
+	if err = validateMessage(m).err(); err != nil {
+		response(ctx, "", err)
+		return
+	}
+	err = updateMessage(m)
 	if err == nil {
 		err = writeMessagesToFile(messages, cfg.GetString("consume.DataFile"))
 	}
@@ -160,7 +218,149 @@ func apiMessageStatus(ctx *fasthttp.RequestCtx) {
 		response(ctx, "", err)
 		return
 	}
-	ctx.WriteString("{\"code\":1,\"data\":" + j + "}")
+	bindings, _ := json.Marshal(bindingsStatus(exchangeName))
+	ctx.WriteString("{\"code\":1,\"data\":" + j + ",\"bindings\":" + string(bindings) + "}")
+}
+func apiTokenAdd(ctx *fasthttp.RequestCtx) {
+	if !checkRequest(ctx) {
+		tokenError(ctx)
+		return
+	}
+	Name := string(ctx.QueryArgs().Peek("Name"))
+	Label := string(ctx.QueryArgs().Peek("Label"))
+	Token := string(ctx.QueryArgs().Peek("Token"))
+	ExpireS := string(ctx.QueryArgs().Peek("Expire"))
+	if Name == "" || Label == "" {
+		response(ctx, "", errors.New("args required.10013"))
+		return
+	}
+	var err error
+	if Token == "" {
+		if Token, err = randomToken(); err != nil {
+			response(ctx, "", err)
+			return
+		}
+	}
+	Expire, _ := strconv.ParseInt(ExpireS, 10, 64)
+	t := messageToken{
+		Label:   Label,
+		Token:   Token,
+		Expire:  Expire,
+		Enabled: true,
+	}
+	if ctx.QueryArgs().Has("Enabled") {
+		if t.Enabled, err = parseTokenEnabled(string(ctx.QueryArgs().Peek("Enabled"))); err != nil {
+			response(ctx, "", err)
+			return
+		}
+	}
+	err = addMessageToken(Name, t)
+	if err == nil {
+		err = writeMessagesToFile(messages, cfg.GetString("consume.DataFile"))
+	}
+	//the token is returned only once when it's added
+	response(ctx, t, err)
+}
+func apiTokenUpdate(ctx *fasthttp.RequestCtx) {
+	if !checkRequest(ctx) {
+		tokenError(ctx)
+		return
+	}
+	Name := string(ctx.QueryArgs().Peek("Name"))
+	Label := string(ctx.QueryArgs().Peek("Label"))
+	if Name == "" || Label == "" {
+		response(ctx, "", errors.New("args required.10014"))
+		return
+	}
+	var err error
+	var enabled bool
+	if ctx.QueryArgs().Has("Enabled") {
+		if enabled, err = parseTokenEnabled(string(ctx.QueryArgs().Peek("Enabled"))); err != nil {
+			response(ctx, "", err)
+			return
+		}
+	}
+	//keep the old values when they are not set
+	t, err := updateMessageToken(Name, Label, func(t *messageToken) {
+		if ctx.QueryArgs().Has("Token") {
+			t.Token = string(ctx.QueryArgs().Peek("Token"))
+		}
+		if ctx.QueryArgs().Has("Expire") {
+			t.Expire, _ = strconv.ParseInt(string(ctx.QueryArgs().Peek("Expire")), 10, 64)
+		}
+		if ctx.QueryArgs().Has("Enabled") {
+			t.Enabled = enabled
+		}
+	})
+	if err == nil {
+		err = writeMessagesToFile(messages, cfg.GetString("consume.DataFile"))
+	}
+	response(ctx, t.masked(), err)
+}
+func apiTokenDelete(ctx *fasthttp.RequestCtx) {
+	if !checkRequest(ctx) {
+		tokenError(ctx)
+		return
+	}
+	Name := string(ctx.QueryArgs().Peek("Name"))
+	Label := string(ctx.QueryArgs().Peek("Label"))
+	err := deleteMessageToken(Name, Label)
+	if err == nil {
+		err = writeMessagesToFile(messages, cfg.GetString("consume.DataFile"))
+	}
+	response(ctx, "", err)
+}
+func apiTokenList(ctx *fasthttp.RequestCtx) {
+	if !checkRequest(ctx) {
+		tokenError(ctx)
+		return
+	}
+	msg, _, err := getMessage(string(ctx.QueryArgs().Peek("Name")))
+	if err != nil {
+		response(ctx, "", err)
+		return
+	}
+	tokens := []messageToken{}
+	for _, t := range msg.Tokens {
+		tokens = append(tokens, t.masked())
+	}
+	response(ctx, tokens, nil)
+}
+func apiMessageBind(ctx *fasthttp.RequestCtx) {
+	if !checkRequest(ctx) {
+		tokenError(ctx)
+		return
+	}
+	Name := string(ctx.QueryArgs().Peek("Name"))
+	b := messageBinding{
+		To:       string(ctx.QueryArgs().Peek("To")),
+		RouteKey: string(ctx.QueryArgs().Peek("RouteKey")),
+	}
+	if Name == "" || b.To == "" {
+		response(ctx, "", errors.New("args required.10015"))
+		return
+	}
+	err := addBinding(Name, b)
+	if err == nil {
+		err = writeMessagesToFile(messages, cfg.GetString("consume.DataFile"))
+	}
+	response(ctx, "", err)
+}
+func apiMessageUnbind(ctx *fasthttp.RequestCtx) {
+	if !checkRequest(ctx) {
+		tokenError(ctx)
+		return
+	}
+	Name := string(ctx.QueryArgs().Peek("Name"))
+	b := messageBinding{
+		To:       string(ctx.QueryArgs().Peek("To")),
+		RouteKey: string(ctx.QueryArgs().Peek("RouteKey")),
+	}
+	err := deleteBinding(Name, b)
+	if err == nil {
+		err = writeMessagesToFile(messages, cfg.GetString("consume.DataFile"))
+	}
+	response(ctx, "", err)
 }
 func apiConsumerAdd(ctx *fasthttp.RequestCtx) {
 	if !checkRequest(ctx) {
@@ -185,19 +385,41 @@ func apiConsumerAdd(ctx *fasthttp.RequestCtx) {
 		response(ctx, "", err)
 		return
 	}
-	ID := IDUUID.String()
-	CheckCode := false
-	if CheckCodeS == "1" {
-		CheckCode = true
+	Transform, err := parseTransformArg(ctx)
+	if err != nil {
+		response(ctx, "", err)
+		return
 	}
-	if ok, err := regexp.Match(`[1-9]\d{1,2}`, []byte(CodeS)); !ok || err != nil {
-		response(ctx, "", errors.New("args required.10006"))
+	HeadersMatch, err := parseHeadersMatchArg(ctx)
+	if err != nil {
+		response(ctx, "", err)
 		return
 	}
-	if ok, err := regexp.Match(`[1-9]\d*`, []byte(TimeoutS)); !ok || err != nil {
-		response(ctx, "", errors.New("args required.10007"))
+	Batch, err := parseBatchArg(ctx)
+	if err != nil {
+		response(ctx, "", err)
+		return
+	}
+	Partition, err := parsePartitionArg(ctx)
+	if err != nil {
+		response(ctx, "", err)
 		return
 	}
+	CircuitBreaker, err := parseCircuitBreakerArg(ctx)
+	if err != nil {
+		response(ctx, "", err)
+		return
+	}
+	RateLimit, err := parseRateLimitArg(ctx)
+	if err != nil {
+		response(ctx, "", err)
+		return
+	}
+	ID := IDUUID.String()
+	CheckCode := false
+	if CheckCodeS == "1" {
+		CheckCode = true
+	}
 	CheckCode = true
 	codeI, _ := strconv.Atoi(CodeS)
 	TimeoutI, _ := strconv.Atoi(TimeoutS)
@@ -209,6 +431,19 @@ func apiConsumerAdd(ctx *fasthttp.RequestCtx) {
 		Timeout:   float64(TimeoutI),
 		URL:       URL,
 		RouteKey:  RouteKey,
+		Transform: Transform,
+		Filter:    string(ctx.QueryArgs().Peek("Filter")),
+		Batch:     Batch,
+		Partition: Partition,
+
+		CircuitBreaker: CircuitBreaker,
+		RateLimit:      RateLimit,
+
+		HeadersMatch: HeadersMatch,
+	}
+	if err = validateConsumer(*msg, c).err(); err != nil {
+		response(ctx, "", err)
+		return
 	}
 	err = addConsumer(*msg, c)
 	if err == nil {
@@ -248,14 +483,6 @@ func apiConsumerUpdate(ctx *fasthttp.RequestCtx) {
 	if CheckCodeS == "1" {
 		CheckCode = true
 	}
-	if ok, err := regexp.Match(`[1-9]\d{1,2}`, []byte(CodeS)); !ok || err != nil {
-		response(ctx, "", errors.New("args required.10009"))
-		return
-	}
-	if ok, err := regexp.Match(`[1-9]\d*`, []byte(TimeoutS)); !ok || err != nil {
-		response(ctx, "", errors.New("args required.10010"))
-		return
-	}
 	CheckCode = true
 	codeI, _ := strconv.Atoi(CodeS)
 	TimeoutI, _ := strconv.Atoi(TimeoutS)
@@ -267,6 +494,66 @@ func apiConsumerUpdate(ctx *fasthttp.RequestCtx) {
 		Timeout:   float64(TimeoutI),
 		URL:       URL,
 		RouteKey:  RouteKey,
+		Paused:    c.Paused,
+		Transform: c.Transform,
+		Filter:    c.Filter,
+		Batch:     c.Batch,
+		Partition: c.Partition,
+
+		CircuitBreaker: c.CircuitBreaker,
+		RateLimit:      c.RateLimit,
+
+		HeadersMatch: c.HeadersMatch,
+	}
+	//keep headers match when it's not set
+	if ctx.QueryArgs().Has("HeadersMatch") {
+		if c0.HeadersMatch, err = parseHeadersMatchArg(ctx); err != nil {
+			response(ctx, "", err)
+			return
+		}
+	}
+	//keep filter when it's not set
+	if ctx.QueryArgs().Has("Filter") {
+		c0.Filter = string(ctx.QueryArgs().Peek("Filter"))
+	}
+	//keep transform when it's not set
+	if ctx.QueryArgs().Has("Transform") {
+		if c0.Transform, err = parseTransformArg(ctx); err != nil {
+			response(ctx, "", err)
+			return
+		}
+	}
+	//keep batch when it's not set
+	if ctx.QueryArgs().Has("Batch") {
+		if c0.Batch, err = parseBatchArg(ctx); err != nil {
+			response(ctx, "", err)
+			return
+		}
+	}
+	//keep rate limit when it's not set
+	if ctx.QueryArgs().Has("RateLimit") {
+		if c0.RateLimit, err = parseRateLimitArg(ctx); err != nil {
+			response(ctx, "", err)
+			return
+		}
+	}
+	//keep circuit breaker when it's not set
+	if ctx.QueryArgs().Has("CircuitBreaker") {
+		if c0.CircuitBreaker, err = parseCircuitBreakerArg(ctx); err != nil {
+			response(ctx, "", err)
+			return
+		}
+	}
+	//keep partition when it's not set
+	if ctx.QueryArgs().Has("Partition") {
+		if c0.Partition, err = parsePartitionArg(ctx); err != nil {
+			response(ctx, "", err)
+			return
+		}
+	}
+	if err = validateConsumer(*msg, c0).err(); err != nil {
+		response(ctx, "", err)
+		return
 	}
 	err = updateConsumer(*msg, c0)
 	if err == nil {
@@ -274,6 +561,148 @@ func apiConsumerUpdate(ctx *fasthttp.RequestCtx) {
 	}
 	response(ctx, err, err)
 }
+func apiConsumerTransformTest(ctx *fasthttp.RequestCtx) {
+	if !checkRequest(ctx) {
+		tokenError(ctx)
+		return
+	}
+	exchangeName := string(ctx.QueryArgs().Peek("Name"))
+	ID := string(ctx.QueryArgs().Peek("ID"))
+	var c consumer
+	if ID != "" {
+		c0, _, _, err := getConsumer(exchangeName, ID)
+		if err != nil {
+			response(ctx, "", err)
+			return
+		}
+		c = *c0
+	}
+	//test the transform before saving it
+	if ctx.QueryArgs().Has("Transform") {
+		t, err := parseTransformArg(ctx)
+		if err != nil {
+			response(ctx, "", err)
+			return
+		}
+		c.Transform = t
+	}
+	if c.URL == "" {
+		c.URL = string(ctx.QueryArgs().Peek("URL"))
+	}
+	e := envelope{
+		Body:   string(ctx.QueryArgs().Peek("Body")),
+		Header: map[string]string{},
+		IP:     string(ctx.QueryArgs().Peek("IP")),
+		Method: strings.ToLower(string(ctx.QueryArgs().Peek("Method"))),
+		Args:   string(ctx.QueryArgs().Peek("Args")),
+	}
+	if e.IP == "" {
+		e.IP = "127.0.0.1"
+	}
+	if e.Method == "" {
+		e.Method = "post"
+	}
+	if h := ctx.QueryArgs().Peek("Header"); len(h) > 0 {
+		if err := json.Unmarshal(h, &e.Header); err != nil {
+			response(ctx, "", fmt.Errorf("Header should be json object,%s", err))
+			return
+		}
+	}
+	if c.Transform != nil {
+		if err := c.Transform.check(); err != nil {
+			response(ctx, "", err)
+			return
+		}
+	}
+	req, err := newConsumerRequest(e, c)
+	if err != nil {
+		response(ctx, "", err)
+		return
+	}
+	headers := map[string]string{}
+	req.Header.VisitAll(func(k, v []byte) {
+		headers[string(k)] = string(v)
+	})
+	response(ctx, map[string]interface{}{
+		"URL":     req.URI().String(),
+		"Method":  string(req.Header.Method()),
+		"Headers": headers,
+		"Body":    string(req.Body()),
+	}, nil)
+}
+
+//parseTransformArg parse Transform argument,empty means no transform
+func parseTransformArg(ctx *fasthttp.RequestCtx) (t *transform, err error) {
+	s := ctx.QueryArgs().Peek("Transform")
+	if len(s) == 0 {
+		return
+	}
+	t = &transform{}
+	if err = json.Unmarshal(s, t); err != nil {
+		err = fmt.Errorf("Transform is not valid json object,%s", err)
+	}
+	return
+}
+//parseHeadersMatchArg parse HeadersMatch argument,empty means no headers match
+func parseHeadersMatchArg(ctx *fasthttp.RequestCtx) (m *headersMatch, err error) {
+	s := ctx.QueryArgs().Peek("HeadersMatch")
+	if len(s) == 0 {
+		return
+	}
+	m = &headersMatch{}
+	if err = json.Unmarshal(s, m); err != nil {
+		err = fmt.Errorf("HeadersMatch is not valid json object,%s", err)
+	}
+	return
+}
+//parseBatchArg parse Batch argument,empty means one request per delivery
+func parseBatchArg(ctx *fasthttp.RequestCtx) (b *batch, err error) {
+	s := ctx.QueryArgs().Peek("Batch")
+	if len(s) == 0 {
+		return
+	}
+	b = &batch{}
+	if err = json.Unmarshal(s, b); err != nil {
+		err = fmt.Errorf("Batch is not valid json object,%s", err)
+	}
+	return
+}
+//parsePartitionArg parse Partition argument,empty means deliveries are processed one by one
+func parsePartitionArg(ctx *fasthttp.RequestCtx) (p *partition, err error) {
+	s := ctx.QueryArgs().Peek("Partition")
+	if len(s) == 0 {
+		return
+	}
+	p = &partition{}
+	if err = json.Unmarshal(s, p); err != nil {
+		err = fmt.Errorf("Partition is not valid json object,%s", err)
+	}
+	return
+}
+//parseCircuitBreakerArg parse CircuitBreaker argument,empty means no circuit breaker
+func parseCircuitBreakerArg(ctx *fasthttp.RequestCtx) (cb *circuitBreaker, err error) {
+	s := ctx.QueryArgs().Peek("CircuitBreaker")
+	if len(s) == 0 {
+		return
+	}
+	cb = &circuitBreaker{}
+	if err = json.Unmarshal(s, cb); err != nil {
+		err = fmt.Errorf("CircuitBreaker is not valid json object,%s", err)
+	}
+	return
+}
+//parseRateLimitArg parse RateLimit argument,empty means no rate limit
+func parseRateLimitArg(ctx *fasthttp.RequestCtx) (rl *rateLimit, err error) {
+	s := ctx.QueryArgs().Peek("RateLimit")
+	if len(s) == 0 {
+		return
+	}
+	rl = &rateLimit{}
+	if err = json.Unmarshal(s, rl); err != nil {
+		err = fmt.Errorf("RateLimit is not valid json object,%s", err)
+	}
+	return
+}
 func apiConsumerDelete(ctx *fasthttp.RequestCtx) {
 	if !checkRequest(ctx) {
 		tokenError(ctx)
@@ -303,6 +732,35 @@ func apiConsumerDelete(ctx *fasthttp.RequestCtx) {
 	}
 	response(ctx, "", nil)
 }
+func apiConsumerPause(ctx *fasthttp.RequestCtx) {
+	apiConsumerSetPaused(ctx, true)
+}
+func apiConsumerResume(ctx *fasthttp.RequestCtx) {
+	apiConsumerSetPaused(ctx, false)
+}
+func apiConsumerSetPaused(ctx *fasthttp.RequestCtx, paused bool) {
+	if !checkRequest(ctx) {
+		tokenError(ctx)
+		return
+	}
+	exchangeName := string(ctx.QueryArgs().Peek("Name"))
+	ID := string(ctx.QueryArgs().Peek("ID"))
+	msg, _, err := getMessage(exchangeName)
+	if err != nil {
+		response(ctx, "", errors.New("message not found"))
+		return
+	}
+	c, _, _, err := getConsumer(exchangeName, ID)
+	if err != nil {
+		response(ctx, "", errors.New("consumer not found"))
+		return
+	}
+	err = pauseConsumer(*msg, *c, paused)
+	if err == nil {
+		err = writeMessagesToFile(messages, cfg.GetString("consume.DataFile"))
+	}
+	response(ctx, "", err)
+}
 func apiConsumerStatus(ctx *fasthttp.RequestCtx) {
 	if !checkRequest(ctx) {
 		tokenError(ctx)
@@ -320,6 +778,11 @@ func apiConsumerStatus(ctx *fasthttp.RequestCtx) {
 	}
 }
 func apiPublish(ctx *fasthttp.RequestCtx) {
+	if isShuttingDown() {
+		ctx.Response.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		ctx.WriteString("service is shutting down")
+		return
+	}
 	queryString := string(ctx.QueryArgs().QueryString())
 	exchangeName := ctx.UserValue("name").(string)
 	msg, _, err := getMessage(exchangeName)
@@ -328,16 +791,65 @@ func apiPublish(ctx *fasthttp.RequestCtx) {
 		ctx.WriteString(err.Error())
 		return
 	}
+	ip, ok := clientAllowed(ctx, msg.allowNets, msg.denyNets)
+	if !ok {
+		ctxFunc("apiPublish").With(logger.Fields{"message": msg.Name, "ip": ip.String()}).Warnf("ip denied")
+		ctx.Response.SetStatusCode(fasthttp.StatusForbidden)
+		ctx.WriteString("ip denied")
+		return
+	}
 
 	tokenB := ctx.Request.Header.Peek("Token")
 	token := string(tokenB)
-	if msg.IsNeedToken && token != msg.Token {
+	tokenLabel, ok := msg.checkToken(token)
+	if !ok {
 		ctx.Response.SetStatusCode(fasthttp.StatusInternalServerError)
 		ctx.WriteString("token error")
 		return
 	}
+	ctx.SetUserValue("tokenLabel", tokenLabel)
+	if code, err := checkPublishBody(ctx, msg); err != nil {
+		ctx.Response.SetStatusCode(code)
+		ctx.WriteString(err.Error())
+		return
+	}
+	//repeated publishing with the same Idempotency-Key get the result of the first one
+	published := false
+	if idempotencyKey := string(ctx.Request.Header.Peek("Idempotency-Key")); idempotencyKey != "" && msg.IdempotencyWindow > 0 {
+		if len(idempotencyKey) > idempotencyKeyMaxLength {
+			ctx.Response.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.WriteString(fmt.Sprintf("Idempotency-Key should not be longer than %d bytes", idempotencyKeyMaxLength))
+			return
+		}
+		window := time.Duration(msg.IdempotencyWindow) * time.Second
+		r, pending := idempotency.Reserve(msg.Name, idempotencyKey, window)
+		if pending {
+			ctx.Response.SetStatusCode(fasthttp.StatusConflict)
+			ctx.WriteString("publishing with the same Idempotency-Key is in progress")
+			return
+		}
+		if r != nil {
+			writeIdempotencyResult(ctx, r)
+			return
+		}
+		defer func() {
+			if !published {
+				idempotency.Release(msg.Name, idempotencyKey)
+				return
+			}
+			if err := idempotency.Save(msg.Name, idempotencyKey, newIdempotencyResult(&ctx.Response), window); err != nil {
+				ctxFunc("apiPublish").With(logger.Fields{"message": msg.Name}).Warnf("save Idempotency-Key fail,%s", err)
+			}
+		}()
+	}
 	routeKeyB := ctx.Request.Header.Peek("RouteKey")
 	routeKey := string(routeKeyB)
+	priority, err := parsePriority(ctx.Request.Header.Peek("Priority"))
+	if err != nil {
+		ctx.Response.SetStatusCode(fasthttp.StatusBadRequest)
+		ctx.WriteString(err.Error())
+		return
+	}
 	method := strings.ToLower(string(ctx.Request.Header.Method()))
 	headerMap := make(map[string]string)
 	ignores := cfg.GetStringSlice("publish.IgnoreHeaders")
@@ -359,11 +871,47 @@ func apiPublish(ctx *fasthttp.RequestCtx) {
 	mqMessage := gabs.New()
 	a, _ := json.Marshal(headerMap)
 	mqMessage.Set(string(a), "header")
-	mqMessage.Set(ctx.RemoteIP(), "ip")
+	mqMessage.Set(ip, "ip")
 	mqMessage.Set(encodeString, "body")
 	mqMessage.Set(method, "method")
 	mqMessage.Set(queryString, "args")
-	err = publish(mqMessage.String(), exchangeName, routeKey, token)
+	mqMessage.Set(tokenLabel, "tokenLabel")
+	//request/reply,wait for the response of ReplyConsumer
+	var replyChan <-chan replyMessage
+	if strings.EqualFold(string(ctx.Request.Header.Peek("Reply")), "wait") {
+		if msg.ReplyConsumer == "" {
+			ctx.Response.SetStatusCode(fasthttp.StatusBadRequest)
+			ctx.WriteString("reply is not enabled for message")
+			return
+		}
+		replyTo, err := getReplyQueue()
+		if err != nil {
+			ctx.Response.SetStatusCode(fasthttp.StatusServiceUnavailable)
+			ctx.WriteString(err.Error())
+			return
+		}
+		id, _ := uuid.NewV4()
+		correlationID := id.String()
+		mqMessage.Set(replyTo, "replyTo")
+		mqMessage.Set(correlationID, "correlationId")
+		mqMessage.Set(msg.ReplyConsumer, "replyConsumer")
+		replyChan = waitReply(correlationID)
+		defer cancelReply(correlationID)
+	}
+	//headers exchange route by headers of publishing
+	var headers amqp.Table
+	if msg.Mode == "headers" {
+		headers = amqp.Table{}
+		for k, v := range headerMap {
+			headers[strings.ToLower(k)] = v
+		}
+	}
+	err = publish(mqMessage.String(), exchangeName, routeKey, token, headers, priority)
+	published = err == nil
+	if err == nil && replyChan != nil {
+		writeReply(ctx, replyChan)
+		return
+	}
 	if err == nil {
 		ctx.Response.SetStatusCode(fasthttp.StatusNoContent)
 		return
@@ -372,11 +920,94 @@ func apiPublish(ctx *fasthttp.RequestCtx) {
 	ctx.WriteString(err.Error())
 	return
 }
+//parsePriority parse Priority header of publishing,empty means 0,
+//priority greater than MaxPriority of message is treated as MaxPriority by RabbitMQ
+func parsePriority(s []byte) (priority uint8, err error) {
+	if len(s) == 0 {
+		return
+	}
+	p, err := strconv.Atoi(string(s))
+	if err != nil || p < 0 || p > maxPriority {
+		return 0, fmt.Errorf("Priority should be between 0 and %d", maxPriority)
+	}
+	return uint8(p), nil
+}
+
+//writeReply wait for the reply and write it to publisher,
+//Reply-Timeout header is milliseconds,it can't exceed publish.ReplyTimeout
+func writeReply(ctx *fasthttp.RequestCtx, replyChan <-chan replyMessage) {
+	timeout := time.Duration(cfg.GetInt("publish.ReplyTimeout")) * time.Second
+	if ms, err := strconv.Atoi(string(ctx.Request.Header.Peek("Reply-Timeout"))); err == nil && ms > 0 &&
+		time.Duration(ms)*time.Millisecond < timeout {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	select {
+	case r := <-replyChan:
+		body, err := base64.StdEncoding.DecodeString(r.Body)
+		if err != nil {
+			ctx.Response.SetStatusCode(fasthttp.StatusBadGateway)
+			ctx.WriteString("decode reply fail")
+			return
+		}
+		for k, v := range r.Header {
+			ctx.Response.Header.Set(k, v)
+		}
+		ctx.Response.SetStatusCode(r.Code)
+		ctx.Write(body)
+	case <-time.After(timeout):
+		ctx.Response.SetStatusCode(fasthttp.StatusGatewayTimeout)
+		ctx.WriteString("reply timeout")
+	case <-shutdownChan:
+		ctx.Response.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		ctx.WriteString("service is shutting down")
+	}
+}
+
+//checkPublishBody check body of publishing against limits of message,
+//return http code and error when it's rejected
+func checkPublishBody(ctx *fasthttp.RequestCtx, msg *message) (code int, err error) {
+	body := ctx.Request.Body()
+	if msg.MaxBodyBytes > 0 && int64(len(body)) > msg.MaxBodyBytes {
+		return fasthttp.StatusRequestEntityTooLarge, fmt.Errorf("body is larger than %d bytes", msg.MaxBodyBytes)
+	}
+	if len(msg.ContentTypes) > 0 {
+		mediaType, _, e := mime.ParseMediaType(string(ctx.Request.Header.ContentType()))
+		if ok, _ := inArray(mediaType, msg.ContentTypes); e != nil || !ok {
+			return fasthttp.StatusUnsupportedMediaType, fmt.Errorf("content type should be one of %s", strings.Join(msg.ContentTypes, ","))
+		}
+	}
+	if msg.JSONSchema != nil {
+		var data interface{}
+		if e := json.Unmarshal(body, &data); e != nil {
+			return fasthttp.StatusUnprocessableEntity, fmt.Errorf("body is not valid json,%s", e)
+		}
+		if e := validateJSON(msg.JSONSchema, msg.schemaPatterns, data, "body"); e != nil {
+			return fasthttp.StatusUnprocessableEntity, e
+		}
+	}
+	return
+}
+
+//parseSchemaArg parse JSONSchema argument,empty means no schema
+func parseSchemaArg(ctx *fasthttp.RequestCtx) (schema map[string]interface{}, err error) {
+	s := ctx.QueryArgs().Peek("JSONSchema")
+	if len(s) == 0 {
+		return
+	}
+	if err = json.Unmarshal(s, &schema); err != nil {
+		err = fmt.Errorf("JSONSchema is not valid json object,%s", err)
+	}
+	return
+}
 func apiReload(ctx *fasthttp.RequestCtx) {
 	if !checkRequest(ctx) {
 		tokenError(ctx)
 		return
 	}
+	if string(ctx.QueryArgs().Peek("fromDisk")) == "1" {
+		response(ctx, "", reloadFromDisk())
+		return
+	}
 	reload()
 	response(ctx, "", nil)
 }
@@ -396,6 +1027,13 @@ func apiConfig(ctx *fasthttp.RequestCtx) {
 	//j, e := config()
 	response(ctx, messages, nil)
 }
+func apiPoolStatus(ctx *fasthttp.RequestCtx) {
+	if !checkRequest(ctx) {
+		tokenError(ctx)
+		return
+	}
+	response(ctx, connMgr.status(), nil)
+}
 func apiLogList(ctx *fasthttp.RequestCtx) {
 	if !checkRequest(ctx) {
 		tokenError(ctx)
@@ -487,6 +1125,9 @@ func response(ctx *fasthttp.RequestCtx, data interface{}, err error) {
 	} else {
 		ja.Set(0, "code")
 		ja.Set(err.Error(), "data")
+		if errs, ok := err.(validationErrors); ok {
+			ja.Set(errs, "errors")
+		}
 	}
 	if callbackFunc == "" {
 		fmt.Fprintf(ctx, ja.String())
@@ -495,45 +1136,71 @@ func response(ctx *fasthttp.RequestCtx, data interface{}, err error) {
 	}
 }
 
-func serveAPI(listen, token string) (err error) {
-	ctx := log.With(logger.Fields{"func": "serveAPI"})
+//newAPIServer create the server of api service
+func newAPIServer(token string) *fasthttp.Server {
 	apiToken = token
 	router := fasthttprouter.New()
 	router.GET("/message/add", timeoutFactory(apiMessageAdd))
 	router.GET("/message/update", timeoutFactory(apiMessageUpdate))
 	router.GET("/message/delete", timeoutFactory(apiMessageDelete))
 	router.GET("/message/status", timeoutFactory(apiMessageStatus))
+	router.GET("/message/bind", timeoutFactory(apiMessageBind))
+	router.GET("/message/unbind", timeoutFactory(apiMessageUnbind))
+	router.GET("/message/token/add", timeoutFactory(apiTokenAdd))
+	router.GET("/message/token/update", timeoutFactory(apiTokenUpdate))
+	router.GET("/message/token/delete", timeoutFactory(apiTokenDelete))
+	router.GET("/message/token/list", timeoutFactory(apiTokenList))
 	router.GET("/consumer/add", timeoutFactory(apiConsumerAdd))
 	router.GET("/consumer/update", timeoutFactory(apiConsumerUpdate))
 	router.GET("/consumer/delete", timeoutFactory(apiConsumerDelete))
 	router.GET("/consumer/status", timeoutFactory(apiConsumerStatus))
+	router.GET("/consumer/transform/test", timeoutFactory(apiConsumerTransformTest))
+	router.GET("/consumer/pause", timeoutFactory(apiConsumerPause))
+	router.GET("/consumer/resume", timeoutFactory(apiConsumerResume))
 	router.GET("/reload", timeoutFactory(apiReload))
 	router.GET("/restart", timeoutFactory(apiRestart))
 	router.GET("/config", timeoutFactory(apiConfig))
+	router.GET("/pool/status", timeoutFactory(apiPoolStatus))
 	router.GET("/log", timeoutFactory(apiLog))
 	router.GET("/log/file", apiLogFile)
 	router.GET("/log/list", timeoutFactory(apiLogList))
-	ctx.Infof("Api service started")
 	var h = func(ctx *fasthttp.RequestCtx) {
 		defer access(ctx)
+		if ip, ok := clientAllowed(ctx, apiAllowNets, apiDenyNets); !ok {
+			ctxFunc("serveAPI").With(logger.Fields{"ip": ip.String(), "uri": string(ctx.RequestURI())}).Warnf("ip denied")
+			ctx.SetStatusCode(fasthttp.StatusForbidden)
+			response(ctx, "", errors.New("ip denied"))
+			return
+		}
 		router.Handler(ctx)
 	}
-	if fasthttp.ListenAndServe(listen, h) == nil {
+	return &fasthttp.Server{Handler: h}
+}
+func serveAPI(s *fasthttp.Server, listen string, r *certReloader) (err error) {
+	ctx := log.With(logger.Fields{"func": "serveAPI"})
+	ctx.Infof("Api service started")
+	if err = serve(s, listen, r); err != nil {
 		ctx.Safe().Fatalf("start api fail:%s", err)
 	}
 	return
 }
-func servePublish(listen string) (err error) {
-	ctx := log.With(logger.Fields{"func": "servePublish"})
+//newPublishServer create the server of publish service
+func newPublishServer() *fasthttp.Server {
 	router := fasthttprouter.New()
-	router.POST("/:name", timeoutFactory(apiPublish))
-	router.GET("/:name", timeoutFactory(apiPublish))
-	ctx.Infof("Publish service started")
+	//publishing may wait for reply
+	publishTimeout := apiTimeout + time.Duration(cfg.GetInt("publish.ReplyTimeout"))*time.Second
+	router.POST("/:name", fasthttp.TimeoutHandler(apiPublish, publishTimeout, "timeout"))
+	router.GET("/:name", fasthttp.TimeoutHandler(apiPublish, publishTimeout, "timeout"))
 	var h = func(ctx *fasthttp.RequestCtx) {
 		defer access(ctx)
 		router.Handler(ctx)
 	}
-	if fasthttp.ListenAndServe(listen, h) == nil {
+	return &fasthttp.Server{Handler: h, MaxRequestBodySize: cfg.GetInt("publish.MaxBodyBytes")}
+}
+func servePublish(s *fasthttp.Server, listen string, r *certReloader) (err error) {
+	ctx := log.With(logger.Fields{"func": "servePublish"})
+	ctx.Infof("Publish service started")
+	if err = serve(s, listen, r); err != nil {
 		ctx.Safe().Fatalf("start publish fail:%s", err)
 	}
 	return
@@ -554,5 +1221,8 @@ func access(ctx *fasthttp.RequestCtx) {
 		"response":   string(ctx.Response.Body()),
 		"post":       post,
 	}
+	if label, ok := ctx.UserValue("tokenLabel").(string); ok {
+		fields["tokenLabel"] = label
+	}
 	accessLog.With(fields).Info("")
 }
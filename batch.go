@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	logger "github.com/snail007/mini-logger"
+	"github.com/streadway/amqp"
+	"github.com/valyala/fasthttp"
+)
+
+//batch send deliveries to consumer's URL in one POST request,
+//the batch is sent when MaxItems or MaxBytes reached or MaxWait elapsed
+//since the first delivery of the batch.
+type batch struct {
+	MaxItems int
+	//MaxBytes total bytes of bodies,0 means no limit
+	MaxBytes int
+	//MaxWait milliseconds
+	MaxWait int
+	//Format json send a JSON array of bodies,ndjson send one body per line
+	Format string
+}
+
+const (
+	batchFormatJSON   = "json"
+	batchFormatNDJSON = "ndjson"
+	batchMaxItems     = 10000
+)
+
+//check return error when batch is malformed
+func (b *batch) check() error {
+	if b.MaxItems < 1 || b.MaxItems > batchMaxItems {
+		return fmt.Errorf("MaxItems should be between 1 and %d", batchMaxItems)
+	}
+	if b.MaxBytes < 0 {
+		return errors.New("MaxBytes should not be less than 0")
+	}
+	if b.MaxWait <= 0 {
+		return errors.New("MaxWait should be greater than 0")
+	}
+	if ok, _ := inArray(b.Format, []string{"", batchFormatJSON, batchFormatNDJSON}); !ok {
+		return fmt.Errorf("Format should be one of %s,%s", batchFormatJSON, batchFormatNDJSON)
+	}
+	return nil
+}
+
+//prefetch return the qos of consumer's channel,
+//RabbitMQ should push a whole batch or one delivery per partition without waiting for ack.
+func (c consumer) prefetch() int {
+	if c.Batch != nil {
+		return c.Batch.MaxItems
+	}
+	if c.Partition != nil {
+		return c.Partition.Concurrency
+	}
+	return 1
+}
+
+type batchItem struct {
+	delivery amqp.Delivery
+	envelope envelope
+	//err is the reason why the delivery is not sent,it's acked with the batch
+	err error
+}
+
+//batcher is owned by consumer worker,it holds the deliveries not acked yet,
+//the worker is in-flight while batcher is not empty.
+type batcher struct {
+	items []batchItem
+	bytes int
+	timer *time.Timer
+}
+
+func (b *batcher) len() int {
+	return len(b.items)
+}
+
+//add return true when the batch is full and should be sent
+func (b *batcher) add(d amqp.Delivery, c consumer) bool {
+	if len(b.items) == 0 {
+		b.timer = time.NewTimer(time.Duration(c.Batch.MaxWait) * time.Millisecond)
+	}
+	item := batchItem{delivery: d}
+	item.envelope, item.err = parseEnvelope(string(d.Body))
+	if item.err == nil {
+		matched, err := filterMatch(c.Filter, item.envelope)
+		if err != nil {
+			item.err = err
+		} else if !matched {
+			item.err = errFiltered
+		}
+	}
+	//the same delivery always fail to transform,so it's dropped
+	if item.err == nil && c.Transform != nil && c.Transform.Body != "" {
+		item.envelope.Body, item.err = renderTemplate("Body", c.Transform.Body, item.envelope.templateData(c))
+	}
+	if item.err == nil {
+		b.bytes += len(item.envelope.Body)
+	}
+	b.items = append(b.items, item)
+	return len(b.items) >= c.Batch.MaxItems || (c.Batch.MaxBytes > 0 && b.bytes >= c.Batch.MaxBytes)
+}
+
+//wait return the chan fired when MaxWait elapsed,nil when batch is empty
+func (b *batcher) wait() <-chan time.Time {
+	if len(b.items) == 0 {
+		return nil
+	}
+	return b.timer.C
+}
+
+//reset drop the deliveries,they are requeued by RabbitMQ when the channel is closed
+func (b *batcher) reset() {
+	if len(b.items) == 0 {
+		return
+	}
+	b.timer.Stop()
+	b.items = nil
+	b.bytes = 0
+	endDelivery()
+}
+
+//send process the batch,all deliveries are acked on success and requeued on fail,
+//return the duration the worker should sleep.wake is the worker's command channel,
+//the batch throttled by rate limit is requeued when a command is sent to worker.
+func (b *batcher) send(c consumer, stats *consumerStats, wake <-chan string, ctx logger.MiniLogger) (sleep time.Duration) {
+	defer b.reset()
+	waitSeconds := time.Duration(cfg.GetInt("consume.GoFailWait"))
+	start := time.Now()
+	var envelopes []envelope
+	for _, item := range b.items {
+		if item.err == nil {
+			envelopes = append(envelopes, item.envelope)
+		}
+	}
+	var code int
+	var err error
+	last := b.items[len(b.items)-1].delivery
+	if len(envelopes) > 0 && !stats.throttle(c.RateLimit, nil, wake) {
+		//shutting down or worker is told to pause,update or exit,requeue the batch
+		last.Nack(true, true)
+		return
+	}
+	if len(envelopes) > 0 {
+		stats.batched()
+		code, err = processBatch(envelopes, c)
+	}
+	if err == nil {
+		for _, item := range b.items {
+			if item.err == errFiltered {
+				stats.filtered()
+			} else if item.err != nil {
+				stats.dropped(item.err)
+			}
+		}
+		if len(envelopes) > 0 {
+			stats.delivered(int64(len(envelopes)), code, time.Since(start))
+		}
+		//ack all deliveries of the batch,they are all before the last one on the channel
+		if err = last.Ack(true); err != nil {
+			ctx.Warnf("ack fail , %s", err)
+			sleep = time.Second * waitSeconds
+		}
+		return
+	}
+	stats.failed(int64(len(envelopes)), code, err, time.Since(start))
+	stats.setState(stateRetrying)
+	if err = last.Nack(true, true); err != nil {
+		ctx.Warnf("nack fail , %s", err)
+		return time.Second * waitSeconds
+	}
+	return time.Second * time.Duration(cfg.GetInt("consume.FailWait"))
+}
+
+//processBatch send bodies of envelopes to consumer's URL in one request
+func processBatch(envelopes []envelope, c consumer) (code int, err error) {
+	ctx := ctxFunc("processBatch").With(logger.Fields{"http": c.URL, "items": fmt.Sprintf("%d", len(envelopes))})
+	req, err := newBatchRequest(envelopes, c)
+	if err != nil {
+		ctx.Warnf("consume fail,%s", err)
+		return
+	}
+	d, _, err := getDeliverer(c.URL)
+	if err != nil {
+		ctx.Warnf("consume fail,%s", err)
+		return
+	}
+	r, err := d.Deliver(req, c)
+	if err != nil {
+		ctx.Warnf("consume fail,%s", err)
+		return
+	}
+	code = r.Code
+	if err = checkConsumerCode(c, code); err != nil {
+		ctx.With(logger.Fields{"httpCode": fmt.Sprintf("%d", code)}).Warnf("%s", err)
+		return
+	}
+	ctx.Debugf("consume success")
+	return
+}
+
+//newBatchRequest build the POST request of envelopes,json body is kept as it is,
+//other body is a json string.
+func newBatchRequest(envelopes []envelope, c consumer) (req *fasthttp.Request, err error) {
+	var buf bytes.Buffer
+	contentType := "application/x-ndjson"
+	if c.Batch.Format != batchFormatNDJSON {
+		contentType = "application/json"
+		buf.WriteByte('[')
+	}
+	for i, e := range envelopes {
+		body := e.Body
+		var item bytes.Buffer
+		if json.Valid([]byte(body)) {
+			//compact it,so one item is one line
+			json.Compact(&item, []byte(body))
+		} else {
+			b, _ := json.Marshal(body)
+			item.Write(b)
+		}
+		if c.Batch.Format == batchFormatNDJSON {
+			buf.Write(item.Bytes())
+			buf.WriteByte('\n')
+			continue
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(item.Bytes())
+	}
+	if c.Batch.Format != batchFormatNDJSON {
+		buf.WriteByte(']')
+	}
+	req = &fasthttp.Request{}
+	req.SetRequestURI(c.URL)
+	req.Header.SetMethod("POST")
+	req.Header.SetContentType(contentType)
+	req.Header.SetUserAgent("wmq v" + cfg.GetString("wmq.version") + " - https://github.com/snail007/wmq")
+	req.SetBody(buf.Bytes())
+	return
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+
+	logger "github.com/snail007/mini-logger"
+	"github.com/streadway/amqp"
+)
+
+//messageBinding route messages of one message to another message,
+//it's an exchange-to-exchange binding,RouteKey is matched by the source exchange.
+type messageBinding struct {
+	To       string
+	RouteKey string
+}
+
+func exchangeBind(source, destination, routeKey string) (err error) {
+	source = getExchangeName(source)
+	destination = getExchangeName(destination)
+	ctx := ctxFunc("exchangeBind").With(logger.Fields{"source": source, "destination": destination})
+	var channel *amqp.Channel
+	channel, err = getMqChannel()
+	defer func() { channelPools.Put(channel) }()
+	if err == nil {
+		err = channel.ExchangeBind(destination, routeKey, source, false, nil)
+		if err == nil {
+			ctx.Debugf("success")
+			return
+		}
+	}
+	ctx.Errorf("fail,%s", err)
+	return
+}
+
+func exchangeUnbind(source, destination, routeKey string) (err error) {
+	source = getExchangeName(source)
+	destination = getExchangeName(destination)
+	ctx := ctxFunc("exchangeUnbind").With(logger.Fields{"source": source, "destination": destination})
+	var channel *amqp.Channel
+	channel, err = getMqChannel()
+	defer func() { channelPools.Put(channel) }()
+	if err == nil {
+		err = channel.ExchangeUnbind(destination, routeKey, source, false, nil)
+		if err == nil {
+			ctx.Debugf("success")
+			return
+		}
+	}
+	ctx.Errorf("fail,%s", err)
+	return
+}
+
+//bindMessages bind all messages' bindings,binding is idempotent in RabbitMQ,
+//so it's safe to call after exchanges were declared again.
+func bindMessages(messages0 []message) (err error) {
+	for _, m := range messages0 {
+		for _, b := range m.Bindings {
+			if err = exchangeBind(m.Name, b.To, b.RouteKey); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+//sourceBinding is a binding with the message it routes from
+type sourceBinding struct {
+	From string
+	messageBinding
+}
+
+//diffBindings return bindings in newMessages but not in oldMessages,and the reverse.
+//bindings from or to a removed message are not in removed,RabbitMQ removes them with the exchange.
+func diffBindings(oldMessages, newMessages []message) (added, removed []sourceBinding) {
+	for _, nm := range newMessages {
+		om := findMessage(oldMessages, nm.Name)
+		for _, b := range nm.Bindings {
+			if om == nil || findBinding(om.Bindings, b) < 0 {
+				added = append(added, sourceBinding{From: nm.Name, messageBinding: b})
+			}
+		}
+	}
+	for _, om := range oldMessages {
+		nm := findMessage(newMessages, om.Name)
+		if nm == nil {
+			continue
+		}
+		for _, b := range om.Bindings {
+			if findMessage(newMessages, b.To) != nil && findBinding(nm.Bindings, b) < 0 {
+				removed = append(removed, sourceBinding{From: om.Name, messageBinding: b})
+			}
+		}
+	}
+	return
+}
+
+func findBinding(bindings []messageBinding, b messageBinding) int {
+	for i := range bindings {
+		if reflect.DeepEqual(bindings[i], b) {
+			return i
+		}
+	}
+	return -1
+}
+
+//addBinding bind message name to b.To
+func addBinding(name string, b messageBinding) (err error) {
+	ctx := ctxFunc("addBinding").With(logger.Fields{"message": name, "to": b.To})
+	msgLock.Lock()
+	defer msgLock.Unlock()
+	msg, i, err := getMessage(name)
+	if err != nil {
+		return
+	}
+	if _, _, err = getMessage(b.To); err != nil {
+		return errors.New("message of To not found")
+	}
+	if findBinding(msg.Bindings, b) >= 0 {
+		return errors.New("binding exists")
+	}
+	msg.Bindings = append(append([]messageBinding{}, msg.Bindings...), b)
+	if err = validateMessage(*msg).err(); err != nil {
+		return
+	}
+	if err = exchangeBind(name, b.To, b.RouteKey); err != nil {
+		return
+	}
+	messages[i].Bindings = msg.Bindings
+	ctx.Infof("bound")
+	return
+}
+
+//deleteBinding unbind message name from b.To
+func deleteBinding(name string, b messageBinding) (err error) {
+	ctx := ctxFunc("deleteBinding").With(logger.Fields{"message": name, "to": b.To})
+	msgLock.Lock()
+	defer msgLock.Unlock()
+	msg, i, err := getMessage(name)
+	if err != nil {
+		return
+	}
+	k := findBinding(msg.Bindings, b)
+	if k < 0 {
+		return errors.New("binding not found")
+	}
+	if err = exchangeUnbind(name, b.To, b.RouteKey); err != nil {
+		return
+	}
+	messages[i].Bindings = append(append([]messageBinding{}, msg.Bindings[:k]...), msg.Bindings[k+1:]...)
+	ctx.Infof("unbound")
+	return
+}
+
+//removeBindingsTo remove bindings to message name from data,
+//RabbitMQ remove them when the exchange is deleted.caller must hold msgLock.
+func removeBindingsTo(name string) {
+	for i := range messages {
+		var bindings []messageBinding
+		for _, b := range messages[i].Bindings {
+			if b.To != name {
+				bindings = append(bindings, b)
+			}
+		}
+		if len(bindings) != len(messages[i].Bindings) {
+			messages[i].Bindings = bindings
+		}
+	}
+}
+
+//bindingsStatus return bindings from and to message name
+func bindingsStatus(name string) map[string]interface{} {
+	msgLock.Lock()
+	defer msgLock.Unlock()
+	outgoing := []messageBinding{}
+	incoming := []map[string]string{}
+	for _, m := range messages {
+		for _, b := range m.Bindings {
+			if m.Name == name {
+				outgoing = append(outgoing, b)
+			}
+			if b.To == name {
+				incoming = append(incoming, map[string]string{"From": m.Name, "RouteKey": b.RouteKey})
+			}
+		}
+	}
+	return map[string]interface{}{"Outgoing": outgoing, "Incoming": incoming}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffBindings(t *testing.T) {
+	b := func(to, routeKey string) messageBinding {
+		return messageBinding{To: to, RouteKey: routeKey}
+	}
+	sb := func(from, to, routeKey string) sourceBinding {
+		return sourceBinding{From: from, messageBinding: b(to, routeKey)}
+	}
+	old := []message{
+		{Name: "a", Bindings: []messageBinding{b("b", "#"), b("c", "order.*")}},
+		{Name: "b"},
+		{Name: "c"},
+		{Name: "d", Bindings: []messageBinding{b("b", "#")}},
+	}
+	tests := []struct {
+		name           string
+		messages       []message
+		added, removed []sourceBinding
+	}{
+		{"unchanged", old, nil, nil},
+		{"added", []message{
+			{Name: "a", Bindings: []messageBinding{b("b", "#"), b("c", "order.*"), b("d", "#")}},
+			{Name: "b"}, {Name: "c"}, {Name: "d", Bindings: []messageBinding{b("b", "#")}},
+		}, []sourceBinding{sb("a", "d", "#")}, nil},
+		{"route key changed", []message{
+			{Name: "a", Bindings: []messageBinding{b("b", "#"), b("c", "order.paid")}},
+			{Name: "b"}, {Name: "c"}, {Name: "d", Bindings: []messageBinding{b("b", "#")}},
+		}, []sourceBinding{sb("a", "c", "order.paid")}, []sourceBinding{sb("a", "c", "order.*")}},
+		{"source removed", []message{
+			{Name: "a", Bindings: []messageBinding{b("b", "#"), b("c", "order.*")}},
+			{Name: "b"}, {Name: "c"},
+		}, nil, nil},
+		{"destination removed", []message{
+			{Name: "a", Bindings: []messageBinding{b("b", "#")}},
+			{Name: "b"}, {Name: "d", Bindings: []messageBinding{b("b", "#")}},
+		}, nil, nil},
+		{"new source", []message{
+			{Name: "a", Bindings: []messageBinding{b("b", "#"), b("c", "order.*")}},
+			{Name: "b"}, {Name: "c"}, {Name: "d", Bindings: []messageBinding{b("b", "#")}},
+			{Name: "e", Bindings: []messageBinding{b("a", "#")}},
+		}, []sourceBinding{sb("e", "a", "#")}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed := diffBindings(old, tt.messages)
+			if !reflect.DeepEqual(added, tt.added) {
+				t.Fatalf("added %v, want %v", added, tt.added)
+			}
+			if !reflect.DeepEqual(removed, tt.removed) {
+				t.Fatalf("removed %v, want %v", removed, tt.removed)
+			}
+		})
+	}
+}
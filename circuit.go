@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+//circuitBreaker stop consuming when consumer's URL keeps failing,
+//deliveries stay in the queue until the circuit is closed.
+type circuitBreaker struct {
+	//FailureThreshold consecutive fails to open the circuit
+	FailureThreshold int
+	//OpenDuration seconds to stop consuming before probing
+	OpenDuration int
+	//HalfOpenProbes success deliveries to close the circuit,one fail opens it again
+	HalfOpenProbes int
+}
+
+//circuitProbeWait is how long a partition lane waits for room of probes
+var circuitProbeWait = time.Millisecond * 100
+
+//circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+//check return error when circuit breaker is malformed
+func (cb *circuitBreaker) check() error {
+	if cb.FailureThreshold < 1 {
+		return errors.New("FailureThreshold should be greater than 0")
+	}
+	if cb.OpenDuration < 1 {
+		return errors.New("OpenDuration should be greater than 0")
+	}
+	if cb.HalfOpenProbes < 1 {
+		return errors.New("HalfOpenProbes should be greater than 0")
+	}
+	return nil
+}
+
+//circuitCheck update the circuit state by delivery counters,
+//return how long consuming should stop,0 means consuming is allowed.
+func (s *consumerStats) circuitCheck(cb *circuitBreaker) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cb == nil {
+		s.Circuit = ""
+		return 0
+	}
+	openDuration := time.Duration(cb.OpenDuration) * time.Second
+	switch s.Circuit {
+	case circuitOpen:
+		if remain := s.circuitOpenTime.Add(openDuration).Sub(time.Now()); remain > 0 {
+			return remain
+		}
+		s.Circuit = circuitHalfOpen
+		s.probeDelivered, s.probeFailed = s.Delivered, s.Failed
+	case circuitHalfOpen:
+		if s.Failed > s.probeFailed {
+			s.openCircuit()
+			return openDuration
+		}
+		if s.Delivered-s.probeDelivered >= int64(cb.HalfOpenProbes) {
+			s.Circuit = circuitClosed
+		}
+	default:
+		s.Circuit = circuitClosed
+		if s.ConsecutiveFails >= int64(cb.FailureThreshold) {
+			s.openCircuit()
+			return openDuration
+		}
+	}
+	return 0
+}
+
+//circuitRoom return how many deliveries can be sent while the circuit is half-open,
+//-1 means no limit.deliveries in-flight or delivered since half-open are probes.
+func (s *consumerStats) circuitRoom(cb *circuitBreaker) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.circuitRoomLocked(cb)
+}
+
+func (s *consumerStats) circuitRoomLocked(cb *circuitBreaker) int {
+	if cb == nil || s.Circuit != circuitHalfOpen {
+		return -1
+	}
+	room := int64(cb.HalfOpenProbes) - (s.Delivered - s.probeDelivered) - s.inFlight
+	if room < 0 {
+		return 0
+	}
+	return int(room)
+}
+
+//circuitAcquire start a delivery processed concurrently,return false when
+//there is no room for probes,circuitRelease must be called after it returns true.
+func (s *consumerStats) circuitAcquire(cb *circuitBreaker) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.circuitRoomLocked(cb) == 0 {
+		return false
+	}
+	s.inFlight++
+	return true
+}
+
+func (s *consumerStats) circuitRelease() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.inFlight--
+}
+
+//openCircuit caller must hold lock
+func (s *consumerStats) openCircuit() {
+	s.Circuit = circuitOpen
+	s.circuitOpenTime = time.Now()
+	s.CircuitOpenTime = s.circuitOpenTime.Unix()
+	s.CircuitOpens++
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitCheck(t *testing.T) {
+	cb := &circuitBreaker{FailureThreshold: 2, OpenDuration: 60, HalfOpenProbes: 2}
+	fail := errors.New("fail")
+	failOne := func(s *consumerStats) { s.failed(1, 500, fail, 0) }
+	deliverOne := func(s *consumerStats) { s.delivered(1, 200, 0) }
+	//expire let the open duration elapse
+	expire := func(s *consumerStats) {
+		s.circuitOpenTime = time.Now().Add(-time.Duration(cb.OpenDuration+1) * time.Second)
+	}
+	tests := []struct {
+		name  string
+		steps []func(s *consumerStats)
+		state string
+		open  bool
+		opens int64
+	}{
+		{"closed", nil, circuitClosed, false, 0},
+		{"below threshold", []func(s *consumerStats){failOne}, circuitClosed, false, 0},
+		{"opened", []func(s *consumerStats){failOne, failOne}, circuitOpen, true, 1},
+		{"success resets", []func(s *consumerStats){failOne, deliverOne, failOne}, circuitClosed, false, 0},
+		{"half-open", []func(s *consumerStats){failOne, failOne, expire}, circuitHalfOpen, false, 1},
+		{"probe fails", []func(s *consumerStats){failOne, failOne, expire, failOne}, circuitOpen, true, 2},
+		{"probes pass", []func(s *consumerStats){failOne, failOne, expire, deliverOne, deliverOne}, circuitClosed, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newConsumerStats()
+			var wait time.Duration
+			for _, step := range tt.steps {
+				step(s)
+				wait = s.circuitCheck(cb)
+			}
+			if len(tt.steps) == 0 {
+				wait = s.circuitCheck(cb)
+			}
+			if s.Circuit != tt.state || (wait > 0) != tt.open || s.CircuitOpens != tt.opens {
+				t.Fatalf("state %s wait %s opens %d, want %s %v %d", s.Circuit, wait, s.CircuitOpens, tt.state, tt.open, tt.opens)
+			}
+		})
+	}
+	t.Run("disabled", func(t *testing.T) {
+		s := newConsumerStats()
+		s.failed(10, 500, fail, 0)
+		if wait := s.circuitCheck(nil); wait != 0 || s.Circuit != "" {
+			t.Fatalf("state %q wait %s", s.Circuit, wait)
+		}
+	})
+}
+
+func TestCircuitHalfOpenProbes(t *testing.T) {
+	cb := &circuitBreaker{FailureThreshold: 1, OpenDuration: 60, HalfOpenProbes: 2}
+	s := newConsumerStats()
+	if s.circuitRoom(cb) != -1 || !s.circuitAcquire(cb) {
+		t.Fatal("closed circuit should not limit deliveries")
+	}
+	s.circuitRelease()
+	s.failed(1, 500, errors.New("fail"), 0)
+	s.circuitCheck(cb)
+	s.circuitOpenTime = time.Now().Add(-time.Minute * 2)
+	s.circuitCheck(cb)
+	if s.Circuit != circuitHalfOpen || s.circuitRoom(cb) != 2 {
+		t.Fatalf("state %s room %d", s.Circuit, s.circuitRoom(cb))
+	}
+	//partitions start concurrently,only HalfOpenProbes of them are allowed
+	if !s.circuitAcquire(cb) || !s.circuitAcquire(cb) || s.circuitAcquire(cb) {
+		t.Fatal("only 2 probes should be in-flight")
+	}
+	//a filtered delivery gives the room back
+	s.circuitRelease()
+	if s.circuitRoom(cb) != 1 {
+		t.Fatalf("room %d after release", s.circuitRoom(cb))
+	}
+	//a delivered probe keeps the room used
+	s.delivered(1, 200, 0)
+	s.circuitRelease()
+	if s.circuitRoom(cb) != 1 || !s.circuitAcquire(cb) || s.circuitAcquire(cb) {
+		t.Fatalf("room %d after delivered", s.circuitRoom(cb))
+	}
+	s.delivered(1, 200, 0)
+	s.circuitRelease()
+	if s.circuitCheck(cb); s.Circuit != circuitClosed {
+		t.Fatalf("state %s after probes", s.Circuit)
+	}
+}
+
+func TestCircuitBreakerCheck(t *testing.T) {
+	tests := []struct {
+		cb circuitBreaker
+		ok bool
+	}{
+		{circuitBreaker{FailureThreshold: 5, OpenDuration: 60, HalfOpenProbes: 3}, true},
+		{circuitBreaker{FailureThreshold: 0, OpenDuration: 60, HalfOpenProbes: 3}, false},
+		{circuitBreaker{FailureThreshold: 5, OpenDuration: 0, HalfOpenProbes: 3}, false},
+		{circuitBreaker{FailureThreshold: 5, OpenDuration: 60, HalfOpenProbes: 0}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.cb.check(); (err == nil) != tt.ok {
+			t.Fatalf("%+v err %v, want ok %v", tt.cb, err, tt.ok)
+		}
+	}
+}
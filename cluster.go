@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//mqNode is one node of RabbitMQ cluster
+type mqNode struct {
+	Addr         string
+	Failures     int
+	LastError    string
+	LastFailTime int64
+	uri          string
+}
+
+var (
+	mqNodes     []*mqNode
+	mqNodesLock = &sync.Mutex{}
+	mqNodesNext int
+)
+
+//initNodes parse rabbitmq.hosts,rabbitmq.host and rabbitmq.port is used when hosts is empty
+func initNodes() (err error) {
+	vhost := cfg.GetString("rabbitmq.vhost")
+	if vhost != "/" {
+		vhost = "/" + vhost
+	}
+	port := strconv.Itoa(cfg.GetInt("rabbitmq.port"))
+	hosts := cfg.GetStringSlice("rabbitmq.hosts")
+	if len(hosts) == 0 {
+		hosts = []string{cfg.GetString("rabbitmq.host")}
+	}
+	mqNodes = nil
+	for _, h := range hosts {
+		if h == "" {
+			continue
+		}
+		if _, _, e := net.SplitHostPort(h); e != nil {
+			h = net.JoinHostPort(h, port)
+		}
+		mqNodes = append(mqNodes, &mqNode{
+			Addr: h,
+			uri: fmt.Sprintf("%s://%s:%s@%s%s",
+				mqScheme(),
+				cfg.GetString("rabbitmq.username"),
+				cfg.GetString("rabbitmq.password"),
+				h,
+				vhost),
+		})
+	}
+	if len(mqNodes) == 0 {
+		err = errors.New("rabbitmq.hosts required")
+	}
+	return
+}
+
+//orderedNodes return nodes to dial in order,healthy nodes are rotated for balance,
+//then the nodes failed earliest.
+func orderedNodes() (nodes []*mqNode) {
+	mqNodesLock.Lock()
+	defer mqNodesLock.Unlock()
+	var healthy, failed []*mqNode
+	for i := range mqNodes {
+		n := mqNodes[(mqNodesNext+i)%len(mqNodes)]
+		if n.Failures == 0 {
+			healthy = append(healthy, n)
+		} else {
+			failed = append(failed, n)
+		}
+	}
+	mqNodesNext++
+	sort.SliceStable(failed, func(i, j int) bool { return failed[i].LastFailTime < failed[j].LastFailTime })
+	return append(healthy, failed...)
+}
+
+func (n *mqNode) success() {
+	mqNodesLock.Lock()
+	defer mqNodesLock.Unlock()
+	n.Failures = 0
+}
+
+func (n *mqNode) fail(err error) {
+	mqNodesLock.Lock()
+	defer mqNodesLock.Unlock()
+	n.Failures++
+	n.LastFailTime = time.Now().Unix()
+	if err != nil {
+		n.LastError = err.Error()
+	}
+}
+
+//nodeFailed mark the node of addr failed,such as a connection on it was closed by error
+func nodeFailed(addr string, err error) {
+	for _, n := range mqNodes {
+		if n.Addr == addr {
+			n.fail(err)
+		}
+	}
+}
+
+//nodesStatus return copies of nodes for status output
+func nodesStatus() (nodes []mqNode) {
+	mqNodesLock.Lock()
+	defer mqNodesLock.Unlock()
+	for _, n := range mqNodes {
+		nodes = append(nodes, *n)
+	}
+	return
+}
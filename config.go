@@ -21,23 +21,46 @@ func initConfig() (err error) {
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.String("listen-api", "0.0.0.0:3302", "api service listening port")
 	pflag.String("listen-publish", "0.0.0.0:3303", "publish service listening port")
+	pflag.String("listen-socket-mode", "0660", "file mode of unix domain socket which listen address is unix:/path/to.sock")
+	pflag.String("listen-api-cert", "", "certificate file of api service,https is enabled when it's set")
+	pflag.String("listen-api-key", "", "key file of api service")
+	pflag.String("listen-api-client-ca", "", "ca file to verify client certificates of api service,empty means no client certificate required")
+	pflag.String("listen-publish-cert", "", "certificate file of publish service,https is enabled when it's set")
+	pflag.String("listen-publish-key", "", "key file of publish service")
 	pflag.String("api-token", "guest", "access api token")
 	configFile := pflag.String("config", "", "config file path")
 	pflag.Bool("api-disable", false, "disable api service")
+	pflag.StringSlice("api-allow", []string{}, "ip or cidr allowed to access api service,empty means all,multiple splitted by comma(,)")
+	pflag.StringSlice("api-deny", []string{}, "ip or cidr denied to access api service,multiple splitted by comma(,)")
+	pflag.Int("publish-max-body", 4*1024*1024, "max body bytes of publishing,larger request is rejected with httpcode 413")
+	pflag.String("idempotency-file", "", "file to keep Idempotency-Key of publishings across restart,empty means in memory only")
+	pflag.Int("reply-timeout", 30, "max seconds to wait for the reply when publishing with header Reply: wait")
+	pflag.StringSlice("trusted-proxies", []string{}, "ip or cidr of trusted proxies,the client ip is read from X-Forwarded-For when request comes from them,multiple splitted by comma(,)")
 	pflag.String("level", "debug", "console log level,should be one of debug,info,warn,error")
 	version := pflag.Bool("version", false, "show version about current WMQ")
 	example := pflag.Bool("data-example", false, "print example of data-file")
 	pflag.StringSlice("ignore-headers", []string{}, "these http headers will be ignored when access to consumer's url , multiple splitted by comma(,)")
 	pflag.String("realip-header", "X-Forwarded-For", "the publisher's real ip will be set in this http header when access to consumer's url")
 	pflag.Int("fail-wait", 50, "access consumer url  fail and then how many seconds to sleep  and retry")
+	pflag.StringSlice("consume-schemes", []string{"http", "https", "tcp"}, "allowed schemes of consumer's URL,should be in http,https,tcp,exec,file,grpc,grpcs,multiple splitted by comma(,)")
+	pflag.Int("shutdown-timeout", 30, "how many seconds to wait for in-flight deliveries when shutting down")
 	pflag.Int("go-fail-wait", 3, "consumer's goroutine occur error and then how many seconds to sleep and retry")
 	pflag.String("mq-host", "127.0.0.1", "which host be used when connect to RabbitMQ")
 	pflag.Int("mq-port", 5672, "which port be used when connect to RabbitMQ")
+	pflag.StringSlice("mq-hosts", []string{}, "RabbitMQ cluster nodes,such as 10.0.0.1:5672,10.0.0.2:5672,multiple splitted by comma(,),mq-host and mq-port is ignored when it's set")
 	pflag.String("mq-username", "guest", "which username be used when connect to RabbitMQ")
 	pflag.String("mq-password", "guest", "which password be used when connect to RabbitMQ")
 	pflag.String("mq-vhost", "/", "which vhost be used when connect to RabbitMQ")
 	pflag.String("mq-prefix", "wmq.", "the queue and exchange default prefix")
+	pflag.String("mq-auth", "plain", "SASL mechanism used when connect to RabbitMQ,should be one of plain,external,external requires mq-tls-cert")
+	pflag.Bool("mq-tls", false, "connect to RabbitMQ with tls (amqps)")
+	pflag.String("mq-tls-ca", "", "ca file to verify RabbitMQ's certificate,empty means system roots")
+	pflag.String("mq-tls-cert", "", "client certificate file used when connect to RabbitMQ")
+	pflag.String("mq-tls-key", "", "client key file used when connect to RabbitMQ")
+	pflag.String("mq-tls-server-name", "", "server name to verify RabbitMQ's certificate,empty means the host of node")
+	pflag.String("mq-tls-min-version", "1.2", "min tls version used when connect to RabbitMQ,should be one of 1.0,1.1,1.2,1.3")
 	pflag.String("data-file", "message.json", "which file will store messages")
+	pflag.Bool("data-file-watch", true, "reload data-file automatically when it was changed")
 	pflag.String("log-dir", "log", "the directory which store log files")
 	pflag.Bool("log-access", true, "access log on or off")
 	pflag.Bool("log-post", false, "log post data on or off")
@@ -56,19 +79,42 @@ func initConfig() (err error) {
 	}
 	cfg.BindPFlag("listen.api", pflag.Lookup("listen-api"))
 	cfg.BindPFlag("listen.publish", pflag.Lookup("listen-publish"))
+	cfg.BindPFlag("listen.socketMode", pflag.Lookup("listen-socket-mode"))
+	cfg.BindPFlag("listen.apiCert", pflag.Lookup("listen-api-cert"))
+	cfg.BindPFlag("listen.apiKey", pflag.Lookup("listen-api-key"))
+	cfg.BindPFlag("listen.apiClientCA", pflag.Lookup("listen-api-client-ca"))
+	cfg.BindPFlag("listen.publishCert", pflag.Lookup("listen-publish-cert"))
+	cfg.BindPFlag("listen.publishKey", pflag.Lookup("listen-publish-key"))
 	cfg.BindPFlag("api.token", pflag.Lookup("api-token"))
 	cfg.BindPFlag("api.disable", pflag.Lookup("api-disable"))
+	cfg.BindPFlag("api.allow", pflag.Lookup("api-allow"))
+	cfg.BindPFlag("api.deny", pflag.Lookup("api-deny"))
+	cfg.BindPFlag("publish.TrustedProxies", pflag.Lookup("trusted-proxies"))
+	cfg.BindPFlag("publish.MaxBodyBytes", pflag.Lookup("publish-max-body"))
+	cfg.BindPFlag("publish.ReplyTimeout", pflag.Lookup("reply-timeout"))
+	cfg.BindPFlag("publish.IdempotencyFile", pflag.Lookup("idempotency-file"))
 	cfg.BindPFlag("publish.IgnoreHeaders", pflag.Lookup("ignore-headers"))
 	cfg.BindPFlag("publish.RealIpHeader", pflag.Lookup("realip-header"))
 	cfg.BindPFlag("consume.FailWait", pflag.Lookup("fail-wait"))
 	cfg.BindPFlag("consume.GoFailWait", pflag.Lookup("go-fail-wait"))
+	cfg.BindPFlag("consume.ShutdownTimeout", pflag.Lookup("shutdown-timeout"))
+	cfg.BindPFlag("consume.Schemes", pflag.Lookup("consume-schemes"))
 	cfg.BindPFlag("consume.DataFile", pflag.Lookup("data-file"))
+	cfg.BindPFlag("consume.WatchDataFile", pflag.Lookup("data-file-watch"))
 	cfg.BindPFlag("rabbitmq.host", pflag.Lookup("mq-host"))
 	cfg.BindPFlag("rabbitmq.port", pflag.Lookup("mq-port"))
+	cfg.BindPFlag("rabbitmq.hosts", pflag.Lookup("mq-hosts"))
 	cfg.BindPFlag("rabbitmq.username", pflag.Lookup("mq-username"))
 	cfg.BindPFlag("rabbitmq.password", pflag.Lookup("mq-password"))
 	cfg.BindPFlag("rabbitmq.vhost", pflag.Lookup("mq-vhost"))
 	cfg.BindPFlag("rabbitmq.prefix", pflag.Lookup("mq-prefix"))
+	cfg.BindPFlag("rabbitmq.auth", pflag.Lookup("mq-auth"))
+	cfg.BindPFlag("rabbitmq.tls.enable", pflag.Lookup("mq-tls"))
+	cfg.BindPFlag("rabbitmq.tls.ca", pflag.Lookup("mq-tls-ca"))
+	cfg.BindPFlag("rabbitmq.tls.cert", pflag.Lookup("mq-tls-cert"))
+	cfg.BindPFlag("rabbitmq.tls.key", pflag.Lookup("mq-tls-key"))
+	cfg.BindPFlag("rabbitmq.tls.serverName", pflag.Lookup("mq-tls-server-name"))
+	cfg.BindPFlag("rabbitmq.tls.minVersion", pflag.Lookup("mq-tls-min-version"))
 	cfg.BindPFlag("log.dir", pflag.Lookup("log-dir"))
 	cfg.BindPFlag("log.level", pflag.Lookup("log-level"))
 	cfg.BindPFlag("log.access", pflag.Lookup("log-access"))
@@ -76,7 +122,7 @@ func initConfig() (err error) {
 	cfg.BindPFlag("log.console-level", pflag.Lookup("level"))
 	cfg.BindPFlag("log.fileMaxSize", pflag.Lookup("log-max-size"))
 	cfg.BindPFlag("log.maxCount", pflag.Lookup("log-max-count"))
-	cfg.SetDefault("default.IgnoreHeaders", []string{"Token", "RouteKey", "Host", "Expect", "Accept-Encoding", "Content-Length", "Connection"})
+	cfg.SetDefault("default.IgnoreHeaders", []string{"Token", "RouteKey", "Reply", "Reply-Timeout", "Priority", "Host", "Expect", "Accept-Encoding", "Content-Length", "Connection"})
 	fmt.Printf("%s", *configFile)
 	if *configFile != "" {
 		cfg.SetConfigFile(*configFile)
@@ -96,6 +142,10 @@ func initConfig() (err error) {
 	}
 	err = nil
 	cfg.Set("publish.IgnoreHeaders", append(cfg.GetStringSlice("default.IgnoreHeaders"), cfg.GetStringSlice("publish.IgnoreHeaders")...))
+	//validate command check consumers with the schemes of config file and flags
+	if pflag.Arg(0) == "validate" {
+		os.Exit(validateCommand(pflag.Args()[1:]))
+	}
 	return
 }
 
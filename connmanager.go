@@ -0,0 +1,220 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	logger "github.com/snail007/mini-logger"
+	"github.com/streadway/amqp"
+)
+
+//connManager watch every connection and channel created by pools,
+//dead ones are evicted from pools when RabbitMQ notify close,
+//so pools need not check them with a round-trip to RabbitMQ.
+type connManager struct {
+	lock         *sync.Mutex
+	conns        map[*amqp.Connection]*connInfo
+	channels     map[*amqp.Channel]*amqp.Connection
+	lastID       int64
+	reconnecting bool
+	reconnects   int64
+	lastError    string
+	lastErrTime  int64
+}
+type connInfo struct {
+	ID       int64
+	Node     string
+	Created  int64
+	Blocked  bool
+	Reason   string
+	Channels int
+}
+
+var connMgr = newConnManager()
+
+func newConnManager() *connManager {
+	return &connManager{
+		lock:     &sync.Mutex{},
+		conns:    map[*amqp.Connection]*connInfo{},
+		channels: map[*amqp.Channel]*amqp.Connection{},
+	}
+}
+
+//watchConnection subscribe close and blocked notify of conn which is connected to node
+func (m *connManager) watchConnection(conn *amqp.Connection, node string) {
+	m.lock.Lock()
+	m.lastID++
+	m.conns[conn] = &connInfo{ID: m.lastID, Node: node, Created: time.Now().Unix()}
+	m.lock.Unlock()
+	closeChan := conn.NotifyClose(make(chan *amqp.Error, 1))
+	blockChan := conn.NotifyBlocked(make(chan amqp.Blocking, 1))
+	go func() {
+		for {
+			select {
+			case e := <-closeChan:
+				m.connectionClosed(conn, e)
+				return
+			case b, ok := <-blockChan:
+				if !ok {
+					blockChan = nil
+					continue
+				}
+				m.connectionBlocked(conn, b)
+			}
+		}
+	}()
+}
+
+//watchChannel subscribe close notify of ch which is opened on conn
+func (m *connManager) watchChannel(ch *amqp.Channel, conn *amqp.Connection) {
+	m.lock.Lock()
+	m.channels[ch] = conn
+	if info, ok := m.conns[conn]; ok {
+		info.Channels++
+	}
+	m.lock.Unlock()
+	closeChan := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		<-closeChan
+		m.lock.Lock()
+		delete(m.channels, ch)
+		if info, ok := m.conns[conn]; ok {
+			info.Channels--
+		}
+		m.lock.Unlock()
+	}()
+}
+
+//isConnectionActive return false when conn was closed
+func (m *connManager) isConnectionActive(conn *amqp.Connection) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.conns[conn]
+	return ok
+}
+
+//isChannelActive return false when ch or it's connection was closed
+func (m *connManager) isChannelActive(ch *amqp.Channel) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	conn, ok := m.channels[ch]
+	if !ok {
+		return false
+	}
+	_, ok = m.conns[conn]
+	return ok
+}
+
+func (m *connManager) connectionBlocked(conn *amqp.Connection, b amqp.Blocking) {
+	m.lock.Lock()
+	info, ok := m.conns[conn]
+	if ok {
+		info.Blocked = b.Active
+		info.Reason = b.Reason
+	}
+	m.lock.Unlock()
+	if ok {
+		ctxFunc("connectionBlocked").With(logger.Fields{"conn": strconv.FormatInt(info.ID, 10)}).
+			Warnf("blocked: %v, reason: %s", b.Active, b.Reason)
+	}
+}
+
+//connectionClosed evict conn and it's channels from pools,
+//then reconnect when it was closed by error
+func (m *connManager) connectionClosed(conn *amqp.Connection, e *amqp.Error) {
+	ctx := ctxFunc("connectionClosed")
+	m.lock.Lock()
+	info, ok := m.conns[conn]
+	delete(m.conns, conn)
+	for ch, c := range m.channels {
+		if c == conn {
+			delete(m.channels, ch)
+		}
+	}
+	if e != nil {
+		m.lastError = e.Error()
+		m.lastErrTime = time.Now().Unix()
+	}
+	m.lock.Unlock()
+	if e == nil {
+		//closed by ourselves
+		return
+	}
+	if ok {
+		ctx = ctx.With(logger.Fields{"conn": strconv.FormatInt(info.ID, 10), "node": info.Node})
+		nodeFailed(info.Node, e)
+	}
+	ctx.Warnf("closed by error, %s", e)
+	if channelPools != nil {
+		channelPools.Prune()
+	}
+	if pools != nil {
+		pools.Prune()
+	}
+	m.reconnect()
+}
+
+//reconnect fill the connection pool in background with backoff
+func (m *connManager) reconnect() {
+	m.lock.Lock()
+	if m.reconnecting {
+		m.lock.Unlock()
+		return
+	}
+	m.reconnecting = true
+	m.lock.Unlock()
+	go func() {
+		ctx := ctxFunc("reconnect")
+		defer func() {
+			m.lock.Lock()
+			m.reconnecting = false
+			m.lock.Unlock()
+		}()
+		wait := mqConnectionFailRetrySleep
+		for pools.Len() < poolInitialCap && !isShuttingDown() {
+			conn, err := newMqConnection()
+			if err != nil {
+				m.lock.Lock()
+				m.lastError = err.Error()
+				m.lastErrTime = time.Now().Unix()
+				m.lock.Unlock()
+				ctx.Warnf("fail, retry after %s, %s", wait, err)
+				sleepOrShutdown(wait)
+				if wait *= 2; wait > mqReconnectMaxWait {
+					wait = mqReconnectMaxWait
+				}
+				continue
+			}
+			wait = mqConnectionFailRetrySleep
+			m.lock.Lock()
+			m.reconnects++
+			m.lock.Unlock()
+			pools.Put(conn)
+		}
+		ctx.Infof("connection pool is refilled")
+	}()
+}
+
+//status return the state of pools
+func (m *connManager) status() map[string]interface{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	conns := []connInfo{}
+	for _, info := range m.conns {
+		conns = append(conns, *info)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return map[string]interface{}{
+		"Nodes":           nodesStatus(),
+		"Connections":     conns,
+		"Channels":        len(m.channels),
+		"IdleConnections": pools.Len(),
+		"IdleChannels":    channelPools.Len(),
+		"Reconnecting":    m.reconnecting,
+		"Reconnects":      m.reconnects,
+		"LastError":       m.lastError,
+		"LastErrorTime":   m.lastErrTime,
+	}
+}
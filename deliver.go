@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+//Deliverer send the request built from envelope to consumer's target,
+//it's selected by the scheme of consumer's URL.
+type Deliverer interface {
+	//Deliver return the result when the target received the request,
+	//Code is http code,non-http deliverers return 200 for success and 500 for fail.
+	Deliver(req *fasthttp.Request, c consumer) (r *DeliveryResult, err error)
+	//Check return error when the URL is not supported
+	Check(u *url.URL) error
+}
+
+//DeliveryResult is the response of target,it's returned to publisher waiting for reply
+type DeliveryResult struct {
+	Code   int
+	Header map[string]string
+	Body   []byte
+}
+
+var (
+	deliverers     = map[string]Deliverer{}
+	deliverersLock = &sync.RWMutex{}
+)
+
+func init() {
+	registerDeliverer("http", &httpDeliverer{})
+	registerDeliverer("https", &httpDeliverer{})
+	registerDeliverer("tcp", &tcpDeliverer{})
+	registerDeliverer("exec", &execDeliverer{})
+	registerDeliverer("file", &fileDeliverer{locks: map[string]*sync.Mutex{}, lock: &sync.Mutex{}})
+	registerDeliverer("grpc", newGrpcDeliverer(false))
+	registerDeliverer("grpcs", newGrpcDeliverer(true))
+}
+
+//registerDeliverer add or replace the deliverer of scheme
+func registerDeliverer(scheme string, d Deliverer) {
+	deliverersLock.Lock()
+	defer deliverersLock.Unlock()
+	deliverers[scheme] = d
+}
+
+//getDeliverer return deliverer of rawURL,the scheme should be in consume.Schemes
+func getDeliverer(rawURL string) (d Deliverer, u *url.URL, err error) {
+	u, err = url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+	if ok, _ := inArray(u.Scheme, cfg.GetStringSlice("consume.Schemes")); !ok {
+		err = fmt.Errorf("scheme [%s] is not allowed,should be one of %s", u.Scheme, strings.Join(cfg.GetStringSlice("consume.Schemes"), ","))
+		return
+	}
+	deliverersLock.RLock()
+	defer deliverersLock.RUnlock()
+	d, ok := deliverers[u.Scheme]
+	if !ok {
+		err = fmt.Errorf("scheme [%s] not supported", u.Scheme)
+	}
+	return
+}
+
+func consumerTimeout(c consumer) time.Duration {
+	return time.Duration(c.Timeout) * time.Millisecond
+}
+
+//httpDeliverer is the default deliverer,the request is sent as it is
+type httpDeliverer struct{}
+
+func (d *httpDeliverer) Check(u *url.URL) error {
+	if u.Host == "" {
+		return fmt.Errorf("should be %s://host/path", u.Scheme)
+	}
+	return nil
+}
+
+func (d *httpDeliverer) Deliver(req *fasthttp.Request, c consumer) (r *DeliveryResult, err error) {
+	client := fasthttp.Client{}
+	client.MaxConnsPerHost = 65535
+	resp := &fasthttp.Response{}
+	err = client.DoTimeout(req, resp, consumerTimeout(c))
+	if err != nil {
+		return
+	}
+	r = &DeliveryResult{
+		Code:   resp.StatusCode(),
+		Header: map[string]string{},
+		Body:   append([]byte{}, resp.Body()...),
+	}
+	resp.Header.VisitAll(func(k, v []byte) {
+		r.Header[string(k)] = string(v)
+	})
+	return
+}
+
+//tcpDeliverer send body as one line to tcp://host:port,
+//and read one line as response,the line should not start with ERR.
+type tcpDeliverer struct{}
+
+func (d *tcpDeliverer) Check(u *url.URL) error {
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return fmt.Errorf("should be tcp://host:port")
+	}
+	return nil
+}
+
+func (d *tcpDeliverer) Deliver(req *fasthttp.Request, c consumer) (r *DeliveryResult, err error) {
+	u, _ := url.Parse(c.URL)
+	conn, err := net.DialTimeout("tcp", u.Host, consumerTimeout(c))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(consumerTimeout(c)))
+	line := bytes.TrimRight(req.Body(), "\r\n")
+	if bytes.ContainsAny(line, "\r\n") {
+		return nil, fmt.Errorf("body should be one line")
+	}
+	if _, err = conn.Write(append(line, '\n')); err != nil {
+		return
+	}
+	resp, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	r = &DeliveryResult{Code: fasthttp.StatusOK, Body: bytes.TrimRight(resp, "\r\n")}
+	if bytes.HasPrefix(r.Body, []byte("ERR")) {
+		r.Code = fasthttp.StatusInternalServerError
+	}
+	return
+}
+
+//execDeliverer run exec:///path/to/command?arg=a&arg=b with body on stdin,
+//headers of request are passed as environment variables WMQ_HEADER_XXX,
+//exit code 0 means success,stdout is the response.
+type execDeliverer struct{}
+
+func (d *execDeliverer) Check(u *url.URL) error {
+	if u.Host != "" || !filepath.IsAbs(u.Path) {
+		return fmt.Errorf("should be exec:///absolute/path/to/command")
+	}
+	return nil
+}
+
+func (d *execDeliverer) Deliver(req *fasthttp.Request, c consumer) (r *DeliveryResult, err error) {
+	u, _ := url.Parse(c.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), consumerTimeout(c))
+	defer cancel()
+	cmd := exec.CommandContext(ctx, u.Path, u.Query()["arg"]...)
+	cmd.Stdin = bytes.NewReader(req.Body())
+	cmd.Env = os.Environ()
+	req.Header.VisitAll(func(k, v []byte) {
+		name := strings.ToUpper(strings.Replace(string(k), "-", "_", -1))
+		cmd.Env = append(cmd.Env, "WMQ_HEADER_"+name+"="+string(v))
+	})
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	//children of the killed command may keep stdout open,don't wait for them
+	cmd.WaitDelay = time.Second
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("command timeout after %s", consumerTimeout(c))
+	}
+	r = &DeliveryResult{Code: fasthttp.StatusOK, Body: stdout.Bytes()}
+	if _, ok := err.(*exec.ExitError); ok {
+		//the command ran,it's a fail result but not a delivery error
+		r.Code = fasthttp.StatusInternalServerError
+		r.Body = append(r.Body, stderr.Bytes()...)
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+//fileDeliverer append body as one line to file:///path/to/file
+type fileDeliverer struct {
+	locks map[string]*sync.Mutex
+	lock  *sync.Mutex
+}
+
+func (d *fileDeliverer) Check(u *url.URL) error {
+	if u.Host != "" || !filepath.IsAbs(u.Path) {
+		return fmt.Errorf("should be file:///absolute/path/to/file")
+	}
+	return nil
+}
+
+//fileLock serialize appending to the same file from different consumers
+func (d *fileDeliverer) fileLock(path string) *sync.Mutex {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.locks[path]; !ok {
+		d.locks[path] = &sync.Mutex{}
+	}
+	return d.locks[path]
+}
+
+func (d *fileDeliverer) Deliver(req *fasthttp.Request, c consumer) (r *DeliveryResult, err error) {
+	u, _ := url.Parse(c.URL)
+	l := d.fileLock(u.Path)
+	l.Lock()
+	defer l.Unlock()
+	line := bytes.TrimRight(req.Body(), "\r\n")
+	if bytes.ContainsAny(line, "\r\n") {
+		return nil, fmt.Errorf("body should be one line")
+	}
+	f, err := os.OpenFile(u.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		return
+	}
+	return &DeliveryResult{Code: fasthttp.StatusOK}, nil
+}
+
+//grpcDeliverer call the unary method of grpc://host:port/package.Service/Method,
+//grpcs:// is the same over TLS.body is sent as the serialized request message,
+//so publishers send encoded protobuf,and the serialized response message is the response.
+//headers of request are sent as metadata,grpc-status 0 means success.
+type grpcDeliverer struct {
+	client *http.Client
+}
+
+//grpcSkipHeaders are set by grpcDeliverer or not allowed in HTTP/2
+var grpcSkipHeaders = []string{"host", "connection", "content-type", "content-length",
+	"transfer-encoding", "te", "keep-alive", "upgrade"}
+
+func newGrpcDeliverer(tls bool) *grpcDeliverer {
+	protocols := &http.Protocols{}
+	if tls {
+		protocols.SetHTTP2(true)
+	} else {
+		//grpc:// is HTTP/2 without TLS
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	return &grpcDeliverer{client: &http.Client{Transport: &http.Transport{Protocols: protocols}}}
+}
+
+func (d *grpcDeliverer) Check(u *url.URL) error {
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if _, _, err := net.SplitHostPort(u.Host); err != nil || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("should be %s://host:port/package.Service/Method", u.Scheme)
+	}
+	return nil
+}
+
+func (d *grpcDeliverer) Deliver(req *fasthttp.Request, c consumer) (r *DeliveryResult, err error) {
+	u, _ := url.Parse(c.URL)
+	scheme := "http"
+	if u.Scheme == "grpcs" {
+		scheme = "https"
+	}
+	//message is prefixed by compressed flag and length
+	body := req.Body()
+	frame := make([]byte, 5+len(body))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(body)))
+	copy(frame[5:], body)
+	ctx, cancel := context.WithTimeout(context.Background(), consumerTimeout(c))
+	defer cancel()
+	hreq, err := http.NewRequestWithContext(ctx, "POST", scheme+"://"+u.Host+u.Path, bytes.NewReader(frame))
+	if err != nil {
+		return
+	}
+	req.Header.VisitAll(func(k, v []byte) {
+		if ok, _ := inArray(strings.ToLower(string(k)), grpcSkipHeaders); !ok {
+			hreq.Header.Add(string(k), string(v))
+		}
+	})
+	hreq.Header.Set("Content-Type", "application/grpc")
+	hreq.Header.Set("Te", "trailers")
+	hreq.Header.Set("Grpc-Timeout", fmt.Sprintf("%dm", consumerTimeout(c)/time.Millisecond))
+	resp, err := d.client.Do(hreq)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("grpc server responds httpcode %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	r = &DeliveryResult{Code: fasthttp.StatusOK, Header: map[string]string{}}
+	//grpc-status is in headers when the response has no message
+	for _, h := range []http.Header{resp.Header, resp.Trailer} {
+		for k := range h {
+			r.Header[k] = h.Get(k)
+		}
+	}
+	switch r.Header["Grpc-Status"] {
+	case "":
+		return nil, fmt.Errorf("grpc-status is missing in response")
+	case "0":
+	default:
+		r.Code = fasthttp.StatusInternalServerError
+		msg, _ := url.PathUnescape(r.Header["Grpc-Message"])
+		r.Body = []byte("grpc-status " + r.Header["Grpc-Status"] + "," + msg)
+		return r, nil
+	}
+	if len(data) < 5 || data[0] != 0 || int(binary.BigEndian.Uint32(data[1:5])) != len(data)-5 {
+		return nil, fmt.Errorf("response message should be one and not compressed")
+	}
+	r.Body = data[5:]
+	return
+}
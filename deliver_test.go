@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func newDeliveryRequest(body string, header map[string]string) *fasthttp.Request {
+	req := &fasthttp.Request{}
+	req.SetBodyString(body)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func TestGetDeliverer(t *testing.T) {
+	defer cfg.Set("consume.Schemes", cfg.GetStringSlice("consume.Schemes"))
+	tests := []struct {
+		url     string
+		schemes []string
+		ok      bool
+	}{
+		{"http://127.0.0.1/wmq", []string{"http"}, true},
+		{"tcp://127.0.0.1:9000", []string{"http"}, false},
+		{"exec:///bin/cat", []string{"http", "tcp"}, false},
+		{"exec:///bin/cat", []string{"exec"}, true},
+		{"grpcs://127.0.0.1:9000/a.B/C", []string{"grpcs"}, true},
+		{"ftp://127.0.0.1/a", []string{"ftp"}, false},
+		{"://bad", []string{"http"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			cfg.Set("consume.Schemes", tt.schemes)
+			if _, _, err := getDeliverer(tt.url); (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestDelivererCheck(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"http://127.0.0.1/wmq", true},
+		{"http:///wmq", false},
+		{"tcp://127.0.0.1:9000", true},
+		{"tcp://127.0.0.1", false},
+		{"exec:///bin/cat", true},
+		{"exec://host/bin/cat", false},
+		{"exec://bin/cat", false},
+		{"file:///tmp/wmq.log", true},
+		{"file://tmp/wmq.log", false},
+		{"grpc://127.0.0.1:9000/pkg.Service/Method", true},
+		{"grpc://127.0.0.1/pkg.Service/Method", false},
+		{"grpc://127.0.0.1:9000/pkg.Service", false},
+		{"grpc://127.0.0.1:9000/pkg.Service/Method/x", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			d, u, err := getDeliverer(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = d.Check(u); (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTcpDeliverer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimRight(line, "\n")
+				if line == "bad" {
+					conn.Write([]byte("ERR bad line\r\n"))
+					return
+				}
+				conn.Write([]byte("OK " + line + "\n"))
+			}(conn)
+		}
+	}()
+	c := consumer{URL: "tcp://" + ln.Addr().String(), Timeout: 1000}
+	tests := []struct {
+		body string
+		code int
+		resp string
+		ok   bool
+	}{
+		{"hello", 200, "OK hello", true},
+		{"hello\r\n", 200, "OK hello", true},
+		{"bad", 500, "ERR bad line", true},
+		{"a\nb", 0, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			r, err := (&tcpDeliverer{}).Deliver(newDeliveryRequest(tt.body, nil), c)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && (r.Code != tt.code || string(r.Body) != tt.resp) {
+				t.Fatalf("code %d body %q, want %d %q", r.Code, r.Body, tt.code, tt.resp)
+			}
+		})
+	}
+}
+
+func TestExecDeliverer(t *testing.T) {
+	sh := func(script string) string {
+		return "exec:///bin/sh?arg=-c&arg=" + url.QueryEscape(script)
+	}
+	tests := []struct {
+		name    string
+		url     string
+		timeout float64
+		code    int
+		resp    string
+		ok      bool
+	}{
+		{"stdin and headers", sh(`printf "$WMQ_HEADER_X_ORDER_ID:"; cat`), 1000, 200, "7:body", true},
+		{"non-zero exit", sh(`echo out; echo err >&2; exit 3`), 1000, 500, "out\nerr\n", true},
+		{"timeout", sh(`sleep 5`), 100, 0, "", false},
+		{"not found", "exec:///not/found/cmd", 1000, 0, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := consumer{URL: tt.url, Timeout: tt.timeout}
+			r, err := (&execDeliverer{}).Deliver(newDeliveryRequest("body", map[string]string{"X-Order-Id": "7"}), c)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && (r.Code != tt.code || string(r.Body) != tt.resp) {
+				t.Fatalf("code %d body %q, want %d %q", r.Code, r.Body, tt.code, tt.resp)
+			}
+		})
+	}
+}
+
+func TestFileDeliverer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deliveries.log")
+	c := consumer{URL: "file://" + path, Timeout: 1000}
+	d := &fileDeliverer{locks: map[string]*sync.Mutex{}, lock: &sync.Mutex{}}
+	tests := []struct {
+		body string
+		ok   bool
+	}{
+		{"line\n", true},
+		{"a\r\nb", false},
+		{"a\rb", false},
+	}
+	for _, tt := range tests {
+		r, err := d.Deliver(newDeliveryRequest(tt.body, nil), c)
+		if (err == nil) != tt.ok {
+			t.Fatalf("%q err %v, want ok %v", tt.body, err, tt.ok)
+		}
+		if tt.ok && r.Code != 200 {
+			t.Fatalf("%q code %d", tt.body, r.Code)
+		}
+	}
+	//consumers append to the same file concurrently,lines should not be mixed
+	body := strings.Repeat("x", 8192)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := d.Deliver(newDeliveryRequest(strconv.Itoa(i)+body, nil), c); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 16384), 16384)
+	lines := 0
+	for scanner.Scan() {
+		if lines > 0 && !strings.HasSuffix(scanner.Text(), body) {
+			t.Fatalf("line %d is mixed", lines)
+		}
+		lines++
+	}
+	if lines != 21 {
+		t.Fatalf("%d lines, want 21", lines)
+	}
+}
+
+//grpcTestHandler echo the request message of /test.Echo/Say and fail /test.Echo/Fail
+func grpcTestHandler(w http.ResponseWriter, r *http.Request) {
+	data, _ := ioutil.ReadAll(r.Body)
+	if r.ProtoMajor != 2 || r.Header.Get("Content-Type") != "application/grpc" || len(data) < 5 ||
+		int(binary.BigEndian.Uint32(data[1:5])) != len(data)-5 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	if r.URL.Path == "/test.Echo/Fail" {
+		//trailers-only response
+		w.Header().Set("Grpc-Status", "13")
+		w.Header().Set("Grpc-Message", "boom%20now")
+		return
+	}
+	msg := append([]byte(r.Header.Get("X-Order-Id")+":"), data[5:]...)
+	frame := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(msg)))
+	copy(frame[5:], msg)
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.Write(frame)
+	w.Header().Set("Grpc-Status", "0")
+}
+
+func TestGrpcDeliverer(t *testing.T) {
+	h2c := httptest.NewUnstartedServer(http.HandlerFunc(grpcTestHandler))
+	h2c.Config.Protocols = &http.Protocols{}
+	h2c.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2c.Start()
+	defer h2c.Close()
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(grpcTestHandler))
+	h2.EnableHTTP2 = true
+	//the client with untrusted certificate is expected
+	h2.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	h2.StartTLS()
+	defer h2.Close()
+	grpcs := newGrpcDeliverer(true)
+	grpcs.client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{
+		RootCAs: h2.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs,
+	}
+	tests := []struct {
+		name string
+		d    *grpcDeliverer
+		url  string
+		code int
+		resp string
+		ok   bool
+	}{
+		{"grpc", newGrpcDeliverer(false), "grpc://" + h2c.Listener.Addr().String() + "/test.Echo/Say", 200, "7:body", true},
+		{"grpcs", grpcs, "grpcs://" + h2.Listener.Addr().String() + "/test.Echo/Say", 200, "7:body", true},
+		{"grpc-status", newGrpcDeliverer(false), "grpc://" + h2c.Listener.Addr().String() + "/test.Echo/Fail", 500, "grpc-status 13,boom now", true},
+		{"untrusted certificate", newGrpcDeliverer(true), "grpcs://" + h2.Listener.Addr().String() + "/test.Echo/Say", 0, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := consumer{URL: tt.url, Timeout: 1000}
+			r, err := tt.d.Deliver(newDeliveryRequest("body", map[string]string{"X-Order-Id": "7"}), c)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && (r.Code != tt.code || string(r.Body) != tt.resp) {
+				t.Fatalf("code %d body %q, want %d %q", r.Code, r.Body, tt.code, tt.resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//errFiltered is returned by process when the delivery doesn't match the filter of consumer
+var errFiltered = errors.New("filtered")
+
+//filterCache compiled filters of consumers,filters being validated are not cached
+var filterCache = newLRUCache(compiledCacheSize)
+
+//filterRoots are the names can be used in filter expression
+var filterRoots = []string{"body", "header", "query", "ip", "method", "tokenLabel"}
+
+//missing is the value of field which doesn't exist,it equals to null
+type missing struct{}
+
+//filterNode is the compiled expression,it's evaluated against filterData
+type filterNode func(d *filterData) interface{}
+
+type filterData struct {
+	e     envelope
+	body  interface{}
+	query url.Values
+}
+
+func newFilterData(e envelope) *filterData {
+	d := &filterData{e: e}
+	if err := json.Unmarshal([]byte(e.Body), &d.body); err != nil {
+		d.body = missing{}
+	}
+	d.query, _ = url.ParseQuery(e.Args)
+	return d
+}
+
+//lookup return value of path such as body.items.0.amount,header.X-Region,query.id
+func (d *filterData) lookup(path []string) interface{} {
+	switch path[0] {
+	case "ip":
+		return d.e.IP
+	case "method":
+		return d.e.Method
+	case "tokenLabel":
+		return d.e.TokenLabel
+	case "header":
+		name := strings.Join(path[1:], ".")
+		for k, v := range d.e.Header {
+			if strings.EqualFold(k, name) {
+				return v
+			}
+		}
+		return missing{}
+	case "query":
+		name := strings.Join(path[1:], ".")
+		if v, ok := d.query[name]; ok && len(v) > 0 {
+			return v[0]
+		}
+		return missing{}
+	}
+	var v = d.body
+	for _, p := range path[1:] {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			child, ok := node[p]
+			if !ok {
+				return missing{}
+			}
+			v = child
+		case []interface{}:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(node) {
+				return missing{}
+			}
+			v = node[i]
+		default:
+			return missing{}
+		}
+	}
+	return v
+}
+
+//filterMatch return true when the envelope match expression,empty expression match all
+func filterMatch(expr string, e envelope) (bool, error) {
+	if expr == "" {
+		return true, nil
+	}
+	n, err := compileFilter(expr)
+	if err != nil {
+		return false, err
+	}
+	return truthy(n(newFilterData(e))), nil
+}
+
+//compileFilter return the cached filter of expr,it's compiled when it's not cached
+func compileFilter(expr string) (n filterNode, err error) {
+	if v, ok := filterCache.get(expr); ok {
+		return v.(filterNode), nil
+	}
+	if n, err = parseFilter(expr); err != nil {
+		return
+	}
+	filterCache.add(expr, n)
+	return
+}
+
+//parseFilter compile expression such as body.amount > 100 && header.X-Region == "eu"
+func parseFilter(expr string) (n filterNode, err error) {
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return
+	}
+	p := &filterParser{tokens: tokens}
+	if n, err = p.parseOr(); err != nil {
+		return
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s", p.tokens[p.pos].text)
+	}
+	return
+}
+
+//forgetCompiled remove the filter and templates of c from caches,
+//it's called when c is updated or deleted.
+func (c consumer) forgetCompiled() {
+	if c.Filter != "" {
+		filterCache.remove(c.Filter)
+	}
+	if c.Transform == nil {
+		return
+	}
+	for _, text := range []string{c.Transform.URL, c.Transform.Method, c.Transform.Body} {
+		templateCache.remove(text)
+	}
+	for _, text := range c.Transform.Headers {
+		templateCache.remove(text)
+	}
+}
+
+type filterToken struct {
+	kind string //op,ident,string,number
+	text string
+}
+
+func lexFilter(expr string) (tokens []filterToken, err error) {
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case i+1 < len(expr) && inFilterOps(expr[i:i+2]):
+			tokens = append(tokens, filterToken{"op", expr[i : i+2]})
+			i += 2
+		case strings.IndexByte("!<>()", c) >= 0:
+			tokens = append(tokens, filterToken{"op", string(c)})
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(expr) && expr[j] != c {
+				if expr[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			s := expr[i+1 : j]
+			if c == '"' {
+				if s, err = strconv.Unquote(expr[i : j+1]); err != nil {
+					return nil, fmt.Errorf("invalid string at %d", i)
+				}
+			} else {
+				s = strings.Replace(s, "\\'", "'", -1)
+			}
+			tokens = append(tokens, filterToken{"string", s})
+			i = j + 1
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(expr) && (expr[j] == '.' || (expr[j] >= '0' && expr[j] <= '9')) {
+				j++
+			}
+			if _, e := strconv.ParseFloat(expr[i:j], 64); e != nil {
+				return nil, fmt.Errorf("invalid number %s", expr[i:j])
+			}
+			tokens = append(tokens, filterToken{"number", expr[i:j]})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i + 1
+			for j < len(expr) && (expr[j] == '_' || expr[j] == '-' || expr[j] == '.' ||
+				unicode.IsLetter(rune(expr[j])) || unicode.IsDigit(rune(expr[j]))) {
+				j++
+			}
+			tokens = append(tokens, filterToken{"ident", expr[i:j]})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+	}
+	return
+}
+
+func inFilterOps(s string) bool {
+	ok, _ := inArray(s, []string{"||", "&&", "==", "!=", ">=", "<=", "=~"})
+	return ok
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek(text string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == "op" && p.tokens[p.pos].text == text
+}
+
+func (p *filterParser) parseOr() (n filterNode, err error) {
+	if n, err = p.parseAnd(); err != nil {
+		return
+	}
+	for p.peek("||") {
+		p.pos++
+		left := n
+		var right filterNode
+		if right, err = p.parseAnd(); err != nil {
+			return
+		}
+		n = func(d *filterData) interface{} { return truthy(left(d)) || truthy(right(d)) }
+	}
+	return
+}
+
+func (p *filterParser) parseAnd() (n filterNode, err error) {
+	if n, err = p.parseUnary(); err != nil {
+		return
+	}
+	for p.peek("&&") {
+		p.pos++
+		left := n
+		var right filterNode
+		if right, err = p.parseUnary(); err != nil {
+			return
+		}
+		n = func(d *filterData) interface{} { return truthy(left(d)) && truthy(right(d)) }
+	}
+	return
+}
+
+func (p *filterParser) parseUnary() (n filterNode, err error) {
+	if p.peek("!") {
+		p.pos++
+		if n, err = p.parseUnary(); err != nil {
+			return
+		}
+		operand := n
+		return func(d *filterData) interface{} { return !truthy(operand(d)) }, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *filterParser) parseCompare() (n filterNode, err error) {
+	if n, err = p.parsePrimary(); err != nil {
+		return
+	}
+	for _, op := range []string{"==", "!=", ">=", "<=", ">", "<", "=~"} {
+		if !p.peek(op) {
+			continue
+		}
+		p.pos++
+		left := n
+		if op == "=~" {
+			if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != "string" {
+				return nil, errors.New("=~ requires a string of regular expression")
+			}
+			re, e := regexp.Compile(p.tokens[p.pos].text)
+			if e != nil {
+				return nil, e
+			}
+			p.pos++
+			return func(d *filterData) interface{} {
+				v := left(d)
+				if _, ok := v.(missing); ok {
+					return false
+				}
+				return re.MatchString(fmt.Sprint(v))
+			}, nil
+		}
+		var right filterNode
+		if right, err = p.parsePrimary(); err != nil {
+			return
+		}
+		return func(d *filterData) interface{} { return compare(op, left(d), right(d)) }, nil
+	}
+	return
+}
+
+func (p *filterParser) parsePrimary() (n filterNode, err error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	switch t.kind {
+	case "string":
+		return func(*filterData) interface{} { return t.text }, nil
+	case "number":
+		f, _ := strconv.ParseFloat(t.text, 64)
+		return func(*filterData) interface{} { return f }, nil
+	case "ident":
+		switch t.text {
+		case "true", "false":
+			b := t.text == "true"
+			return func(*filterData) interface{} { return b }, nil
+		case "null":
+			return func(*filterData) interface{} { return nil }, nil
+		}
+		path := strings.Split(t.text, ".")
+		if ok, _ := inArray(path[0], filterRoots); !ok {
+			return nil, fmt.Errorf("unknown field %s,should start with one of %s", t.text, strings.Join(filterRoots, ","))
+		}
+		if (path[0] == "header" || path[0] == "query") && len(path) < 2 {
+			return nil, fmt.Errorf("%s requires a name,such as %s.name", path[0], path[0])
+		}
+		return func(d *filterData) interface{} { return d.lookup(path) }, nil
+	}
+	if t.text == "(" {
+		if n, err = p.parseOr(); err != nil {
+			return
+		}
+		if !p.peek(")") {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return
+	}
+	return nil, fmt.Errorf("unexpected %s", t.text)
+}
+
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil, missing:
+		return false
+	case bool:
+		return x
+	case float64:
+		return x != 0
+	case string:
+		return x != ""
+	}
+	return true
+}
+
+//toNumber convert number or numeric string,such as header value
+func toNumber(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+//compare values,numbers are compared when one side is number and the other is numeric,
+//missing field only equals to null.
+func compare(op string, a, b interface{}) bool {
+	if _, ok := a.(missing); ok {
+		a = nil
+	}
+	if _, ok := b.(missing); ok {
+		b = nil
+	}
+	_, aIsNum := a.(float64)
+	_, bIsNum := b.(float64)
+	if aIsNum || bIsNum {
+		x, ok1 := toNumber(a)
+		y, ok2 := toNumber(b)
+		if ok1 && ok2 {
+			switch op {
+			case "==":
+				return x == y
+			case "!=":
+				return x != y
+			case ">":
+				return x > y
+			case ">=":
+				return x >= y
+			case "<":
+				return x < y
+			case "<=":
+				return x <= y
+			}
+		}
+	}
+	switch op {
+	case "==":
+		return reflect.DeepEqual(a, b)
+	case "!=":
+		return !reflect.DeepEqual(a, b)
+	}
+	x, ok1 := a.(string)
+	y, ok2 := b.(string)
+	if !ok1 || !ok2 {
+		return false
+	}
+	switch op {
+	case ">":
+		return x > y
+	case ">=":
+		return x >= y
+	case "<":
+		return x < y
+	case "<=":
+		return x <= y
+	}
+	return false
+}
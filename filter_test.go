@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLexFilter(t *testing.T) {
+	tests := []struct {
+		expr   string
+		tokens []filterToken
+		ok     bool
+	}{
+		{`body.amount >= 100`, []filterToken{{"ident", "body.amount"}, {"op", ">="}, {"number", "100"}}, true},
+		{`header.X-Region=="eu"`, []filterToken{{"ident", "header.X-Region"}, {"op", "=="}, {"string", "eu"}}, true},
+		{`!(a||b)&&c`, []filterToken{{"op", "!"}, {"op", "("}, {"ident", "a"}, {"op", "||"}, {"ident", "b"},
+			{"op", ")"}, {"op", "&&"}, {"ident", "c"}}, true},
+		{`x =~ 'it\'s'`, []filterToken{{"ident", "x"}, {"op", "=~"}, {"string", "it's"}}, true},
+		{`"a\"b"`, []filterToken{{"string", `a"b`}}, true},
+		{`-1.5`, []filterToken{{"number", "-1.5"}}, true},
+		{`"open`, nil, false},
+		{`1.2.3`, nil, false},
+		{`a = b`, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			tokens, err := lexFilter(tt.expr)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && !reflect.DeepEqual(tokens, tt.tokens) {
+				t.Fatalf("tokens %v, want %v", tokens, tt.tokens)
+			}
+		})
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		expr string
+		ok   bool
+	}{
+		{`body.amount > 100 && header.X-Region == "eu"`, true},
+		{`(query.type == "order" || body.items.0.sku =~ "^a-") && !body.test`, true},
+		{`ip == "127.0.0.1" || method == "post" || tokenLabel != null`, true},
+		{`user.id == 1`, false},
+		{`header == "x"`, false},
+		{`body.a >`, false},
+		{`(body.a`, false},
+		{`body.a == 1 )`, false},
+		{`body.a =~ 1`, false},
+		{`body.a =~ "("`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			if _, err := parseFilter(tt.expr); (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	e := envelope{
+		Body:       `{"amount":150,"items":[{"sku":"a-1"}],"test":false,"name":"bob"}`,
+		Header:     map[string]string{"X-Region": "eu", "X-Count": "3"},
+		IP:         "10.0.0.1",
+		Method:     "post",
+		Args:       "type=order&id=7",
+		TokenLabel: "ci",
+	}
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{``, true},
+		{`body.amount > 100`, true},
+		{`body.amount > 200`, false},
+		{`header.x-region == "eu"`, true},
+		{`header.X-Count >= 3`, true},
+		{`query.id == 7`, true},
+		{`query.type == "order" && body.items.0.sku =~ "^a-"`, true},
+		{`body.items.1.sku == null`, true},
+		{`body.missing`, false},
+		{`!body.test`, true},
+		{`body.name > "alice"`, true},
+		{`ip == "10.0.0.1" && method == "post" && tokenLabel == "ci"`, true},
+		{`body.amount > 100 && (header.X-Region == "us" || query.type == "refund")`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			match, err := filterMatch(tt.expr, e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match != tt.match {
+				t.Fatalf("match %v, want %v", match, tt.match)
+			}
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		op   string
+		a, b interface{}
+		want bool
+	}{
+		{"==", 1.0, 1.0, true},
+		{"==", "1", 1.0, true},
+		{"!=", "a", 1.0, true},
+		{"<", 1.0, 2.0, true},
+		{"<=", "2", 2.0, true},
+		{">", "b", "a", true},
+		{">", "b", 1.0, false},
+		{"==", missing{}, nil, true},
+		{"==", missing{}, "", false},
+		{"!=", true, false, true},
+		{">", true, false, false},
+	}
+	for _, tt := range tests {
+		if got := compare(tt.op, tt.a, tt.b); got != tt.want {
+			t.Fatalf("%v %s %v is %v, want %v", tt.a, tt.op, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestFilterCache(t *testing.T) {
+	expr := `body.cached == 1`
+	if _, err := parseFilter(expr); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := filterCache.get(expr); ok {
+		t.Fatal("filter being validated should not be cached")
+	}
+	if _, err := filterMatch(expr, envelope{Body: "{}"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := filterCache.get(expr); !ok {
+		t.Fatal("filter of delivery should be cached")
+	}
+	consumer{Filter: expr}.forgetCompiled()
+	if _, ok := filterCache.get(expr); ok {
+		t.Fatal("filter should be removed when consumer is updated")
+	}
+}
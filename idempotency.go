@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+//idempotencyResult is the response of the first publishing with an Idempotency-Key,
+//it's returned to the publishings with the same key in the window of message.
+type idempotencyResult struct {
+	Code   int
+	Header map[string]string
+	Body   []byte
+}
+
+type idempotencyRecord struct {
+	Message string
+	Key     string
+	Expire  int64
+	//Result nil means the first publishing is in progress
+	Result *idempotencyResult
+}
+
+//idempotencyStore keep Idempotency-Key of publishings in the window of message
+type idempotencyStore interface {
+	//Reserve return the result of key,pending true means the first publishing is in progress,
+	//nil result and false pending mean the key is reserved for the caller
+	Reserve(message, key string, window time.Duration) (r *idempotencyResult, pending bool)
+	//Release remove the reserved key,such as the publishing fail
+	Release(message, key string)
+	//Save the result of the reserved key
+	Save(message, key string, r *idempotencyResult, window time.Duration) error
+}
+
+//idempotency is the store of publishings,it's persistent when publish.IdempotencyFile is set
+var idempotency idempotencyStore = newMemoryIdempotencyStore()
+
+const idempotencyKeyMaxLength = 255
+
+//initIdempotency load the persistent store
+func initIdempotency() (err error) {
+	file := cfg.GetString("publish.IdempotencyFile")
+	if file == "" {
+		return
+	}
+	s, err := newFileIdempotencyStore(file)
+	if err != nil {
+		return
+	}
+	idempotency = s
+	return
+}
+
+type memoryIdempotencyStore struct {
+	records   map[string]*idempotencyRecord
+	lock      *sync.Mutex
+	lastPrune time.Time
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{
+		records: map[string]*idempotencyRecord{},
+		lock:    &sync.Mutex{},
+	}
+}
+
+func idempotencyRecordKey(message, key string) string {
+	return message + "\x00" + key
+}
+
+func (s *memoryIdempotencyStore) Reserve(message, key string, window time.Duration) (r *idempotencyResult, pending bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.prune()
+	if record, ok := s.records[idempotencyRecordKey(message, key)]; ok && record.Expire > time.Now().Unix() {
+		return record.Result, record.Result == nil
+	}
+	s.records[idempotencyRecordKey(message, key)] = &idempotencyRecord{
+		Message: message,
+		Key:     key,
+		Expire:  time.Now().Add(window).Unix(),
+	}
+	return
+}
+
+func (s *memoryIdempotencyStore) Release(message, key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.records, idempotencyRecordKey(message, key))
+}
+
+func (s *memoryIdempotencyStore) Save(message, key string, r *idempotencyResult, window time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.set(&idempotencyRecord{
+		Message: message,
+		Key:     key,
+		Expire:  time.Now().Add(window).Unix(),
+		Result:  r,
+	})
+	return nil
+}
+
+func (s *memoryIdempotencyStore) set(record *idempotencyRecord) {
+	s.records[idempotencyRecordKey(record.Message, record.Key)] = record
+}
+
+//prune remove expired records at most once a minute,caller must hold lock
+func (s *memoryIdempotencyStore) prune() {
+	if time.Since(s.lastPrune) < time.Minute {
+		return
+	}
+	s.lastPrune = time.Now()
+	now := s.lastPrune.Unix()
+	for k, record := range s.records {
+		if record.Expire <= now {
+			delete(s.records, k)
+		}
+	}
+}
+
+//fileIdempotencyStore keep records in memory and append saved records to file,
+//so they survive restart.the file is compacted when it's loaded and when
+//most of its lines are expired or replaced.
+type fileIdempotencyStore struct {
+	*memoryIdempotencyStore
+	path string
+	file *os.File
+	//lines written to file since it was compacted
+	lines int
+}
+
+//idempotencyCompactLines the file is not compacted before it has so many lines
+const idempotencyCompactLines = 1000
+
+func newFileIdempotencyStore(path string) (s *fileIdempotencyStore, err error) {
+	s = &fileIdempotencyStore{memoryIdempotencyStore: newMemoryIdempotencyStore(), path: path}
+	if f, e := os.Open(path); e == nil {
+		now := time.Now().Unix()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			record := &idempotencyRecord{}
+			//broken line such as the last one written when crashed is skipped
+			if json.Unmarshal(scanner.Bytes(), record) == nil && record.Result != nil && record.Expire > now {
+				s.set(record)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return
+		}
+	}
+	err = s.compact()
+	return
+}
+
+//compact rewrite the file with records not expired,caller must hold lock
+func (s *fileIdempotencyStore) compact() (err error) {
+	s.lastPrune = time.Time{}
+	s.prune()
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+	lines := 0
+	for _, record := range s.records {
+		//pending records are not persistent
+		if record.Result == nil {
+			continue
+		}
+		if err = s.write(f, record); err != nil {
+			f.Close()
+			return
+		}
+		lines++
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return
+	}
+	f.Close()
+	if err = os.Rename(tmp, s.path); err != nil {
+		return
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, s.lines = file, lines
+	return
+}
+
+func (s *fileIdempotencyStore) write(f *os.File, record *idempotencyRecord) (err error) {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	_, err = f.Write(append(b, '\n'))
+	return
+}
+
+func (s *fileIdempotencyStore) Save(message, key string, r *idempotencyResult, window time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	record := &idempotencyRecord{
+		Message: message,
+		Key:     key,
+		Expire:  time.Now().Add(window).Unix(),
+		Result:  r,
+	}
+	s.set(record)
+	if s.lines >= idempotencyCompactLines && s.lines >= 2*len(s.records) {
+		if err := s.compact(); err != nil {
+			return err
+		}
+		//record is in the compacted file
+		return nil
+	}
+	if err := s.write(s.file, record); err != nil {
+		return err
+	}
+	s.lines++
+	//the publisher gets the result after it's on disk
+	return s.file.Sync()
+}
+
+//newIdempotencyResult copy the response written to publisher
+func newIdempotencyResult(resp *fasthttp.Response) *idempotencyResult {
+	r := &idempotencyResult{
+		Code:   resp.StatusCode(),
+		Header: map[string]string{},
+		Body:   append([]byte{}, resp.Body()...),
+	}
+	resp.Header.VisitAll(func(k, v []byte) {
+		if ok, _ := inArray(string(k), replyIgnoreHeaders); !ok {
+			r.Header[string(k)] = string(v)
+		}
+	})
+	return r
+}
+
+//writeIdempotencyResult write the result of the first publishing to publisher
+func writeIdempotencyResult(ctx *fasthttp.RequestCtx, r *idempotencyResult) {
+	for k, v := range r.Header {
+		ctx.Response.Header.Set(k, v)
+	}
+	ctx.Response.Header.Set("Idempotent-Replayed", "true")
+	ctx.Response.SetStatusCode(r.Code)
+	ctx.Write(r.Body)
+}
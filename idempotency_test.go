@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyStores(t *testing.T) {
+	stores := []struct {
+		name string
+		new  func(t *testing.T) idempotencyStore
+	}{
+		{"memory", func(t *testing.T) idempotencyStore { return newMemoryIdempotencyStore() }},
+		{"file", func(t *testing.T) idempotencyStore {
+			s, err := newFileIdempotencyStore(filepath.Join(t.TempDir(), "idempotency.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}},
+	}
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			s := st.new(t)
+			steps := []struct {
+				name    string
+				do      func()
+				key     string
+				code    int
+				pending bool
+			}{
+				{"first is reserved", nil, "k1", 0, false},
+				{"second is pending", nil, "k1", 0, true},
+				{"saved is replayed", func() {
+					s.Save("m", "k1", &idempotencyResult{Code: 204}, time.Minute)
+				}, "k1", 204, false},
+				{"released can be reserved", func() {
+					s.Reserve("m", "k2", time.Minute)
+					s.Release("m", "k2")
+				}, "k2", 0, false},
+				{"expired can be reserved", func() {
+					s.Save("m", "k3", &idempotencyResult{Code: 200}, -time.Second)
+				}, "k3", 0, false},
+			}
+			for _, step := range steps {
+				if step.do != nil {
+					step.do()
+				}
+				r, pending := s.Reserve("m", step.key, time.Minute)
+				code := 0
+				if r != nil {
+					code = r.Code
+				}
+				if code != step.code || pending != step.pending {
+					t.Fatalf("%s: code %d pending %v, want %d %v", step.name, code, pending, step.code, step.pending)
+				}
+			}
+			//keys of different messages are different
+			if r, pending := s.Reserve("other", "k1", time.Minute); r != nil || pending {
+				t.Fatal("key of other message should be reserved")
+			}
+		})
+	}
+}
+
+func TestFileIdempotencyStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idempotency.log")
+	s, err := newFileIdempotencyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Reserve("m", "pending", time.Minute)
+	s.Save("m", "saved", &idempotencyResult{Code: 201, Header: map[string]string{"X-Id": "1"}, Body: []byte("ok")}, time.Minute)
+	s.Save("m", "expired", &idempotencyResult{Code: 200}, -time.Second)
+	//the last line written when crashed
+	s.file.WriteString(`{"Message":"m","Key":"broken"`)
+	s.file.Close()
+	s, err = newFileIdempotencyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.file.Close()
+	tests := []struct {
+		key  string
+		code int
+	}{
+		{"saved", 201},
+		{"pending", 0},
+		{"expired", 0},
+		{"broken", 0},
+	}
+	for _, tt := range tests {
+		r, pending := s.Reserve("m", tt.key, time.Minute)
+		code := 0
+		if r != nil {
+			code = r.Code
+		}
+		if code != tt.code || pending {
+			t.Fatalf("%s: code %d pending %v, want %d", tt.key, code, pending, tt.code)
+		}
+	}
+	if r, _ := s.Reserve("m", "saved", time.Minute); r.Header["X-Id"] != "1" || string(r.Body) != "ok" {
+		t.Fatalf("replayed result %+v", r)
+	}
+}
+
+func TestFileIdempotencyStoreCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idempotency.log")
+	s, err := newFileIdempotencyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.file.Close()
+	//the same key saved again and again,the file should not keep every line
+	for i := 0; i < idempotencyCompactLines*3; i++ {
+		if err = s.Save("m", "same", &idempotencyResult{Code: 200}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		lines++
+	}
+	if lines > idempotencyCompactLines {
+		t.Fatalf("file has %d lines, should be compacted", lines)
+	}
+	if r, _ := s.Reserve("m", "same", time.Minute); r == nil || r.Code != 200 {
+		t.Fatalf("result %+v lost after compacted", r)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+//parseCIDRs parse list of ip or cidr,such as 10.0.0.1 or 10.0.0.0/8
+func parseCIDRs(list []string) (nets []*net.IPNet, err error) {
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("[%s] is not an ip or cidr", s)
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, e := net.ParseCIDR(s)
+		if e != nil {
+			return nil, fmt.Errorf("[%s] is not an ip or cidr", s)
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+//api.allow,api.deny and publish.TrustedProxies parsed by initIPFilter
+var (
+	apiAllowNets     []*net.IPNet
+	apiDenyNets      []*net.IPNet
+	trustedProxyNets []*net.IPNet
+)
+
+//initIPFilter parse ip lists of config
+func initIPFilter() (err error) {
+	if apiAllowNets, err = parseCIDRs(cfg.GetStringSlice("api.allow")); err != nil {
+		return fmt.Errorf("api.allow %s", err)
+	}
+	if apiDenyNets, err = parseCIDRs(cfg.GetStringSlice("api.deny")); err != nil {
+		return fmt.Errorf("api.deny %s", err)
+	}
+	if trustedProxyNets, err = parseCIDRs(cfg.GetStringSlice("publish.TrustedProxies")); err != nil {
+		return fmt.Errorf("publish.TrustedProxies %s", err)
+	}
+	return
+}
+
+//parseIPs parse AllowIPs and DenyIPs of message,
+//it's called when message is loaded,added or updated.
+func (m *message) parseIPs() (err error) {
+	if m.allowNets, err = parseCIDRs(m.AllowIPs); err != nil {
+		return fmt.Errorf("AllowIPs %s", err)
+	}
+	if m.denyNets, err = parseCIDRs(m.DenyIPs); err != nil {
+		return fmt.Errorf("DenyIPs %s", err)
+	}
+	return
+}
+
+//ipMatch return true when ip is in any of nets
+func ipMatch(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//ipAllowed deny is checked first,then allow,empty allow means allow all
+func ipAllowed(ip net.IP, allow, deny []*net.IPNet) bool {
+	if ipMatch(ip, deny) {
+		return false
+	}
+	return len(allow) == 0 || ipMatch(ip, allow)
+}
+
+//clientAllowed return the ip of client and whether it's allowed by allow and deny,
+//ip lists don't apply to clients of unix domain socket,they have no ip,
+//the file mode of socket controls who can connect.
+func clientAllowed(ctx *fasthttp.RequestCtx, allow, deny []*net.IPNet) (ip net.IP, ok bool) {
+	ip = clientIP(ctx)
+	if _, unix := ctx.RemoteAddr().(*net.UnixAddr); unix {
+		return ip, true
+	}
+	return ip, ipAllowed(ip, allow, deny)
+}
+
+//clientIP return the ip of client,X-Forwarded-For is used when
+//the request comes from publish.TrustedProxies.
+func clientIP(ctx *fasthttp.RequestCtx) net.IP {
+	ip := ctx.RemoteIP()
+	trusted := trustedProxyNets
+	if len(trusted) == 0 || !ipMatch(ip, trusted) {
+		return ip
+	}
+	forwarded := strings.Split(string(ctx.Request.Header.Peek("X-Forwarded-For")), ",")
+	//the rightmost one which is not a trusted proxy is the client
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			break
+		}
+		ip = forwardedIP
+		if !ipMatch(ip, trusted) {
+			break
+		}
+	}
+	return ip
+}
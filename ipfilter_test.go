@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		name string
+		list []string
+		nets []string
+		ok   bool
+	}{
+		{"empty", nil, nil, true},
+		{"ipv4", []string{"10.0.0.1"}, []string{"10.0.0.1/32"}, true},
+		{"ipv6", []string{"::1"}, []string{"::1/128"}, true},
+		{"cidr", []string{" 10.0.0.0/8 ", "", "fd00::/8"}, []string{"10.0.0.0/8", "fd00::/8"}, true},
+		{"bad ip", []string{"10.0.0.300"}, nil, false},
+		{"bad cidr", []string{"10.0.0.0/33"}, nil, false},
+		{"one bad item", []string{"10.0.0.1", "example.com"}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := parseCIDRs(tt.list)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok %v", err, tt.ok)
+			}
+			if len(nets) != len(tt.nets) {
+				t.Fatalf("nets %v, want %v", nets, tt.nets)
+			}
+			for i, n := range nets {
+				if n.String() != tt.nets[i] {
+					t.Fatalf("nets %v, want %v", nets, tt.nets)
+				}
+			}
+		})
+	}
+}
+
+func mustParseCIDRs(t *testing.T, list ...string) []*net.IPNet {
+	nets, err := parseCIDRs(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+func TestIPAllowed(t *testing.T) {
+	tests := []struct {
+		name  string
+		ip    string
+		allow []string
+		deny  []string
+		ok    bool
+	}{
+		{"no list", "10.0.0.1", nil, nil, true},
+		{"allowed", "10.0.0.1", []string{"10.0.0.0/8"}, nil, true},
+		{"not allowed", "192.168.0.1", []string{"10.0.0.0/8"}, nil, false},
+		{"denied", "10.0.0.1", nil, []string{"10.0.0.1"}, false},
+		{"deny first", "10.0.0.1", []string{"10.0.0.0/8"}, []string{"10.0.0.1"}, false},
+		{"ipv6", "fd00::1", []string{"fd00::/8"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok := ipAllowed(net.ParseIP(tt.ip), mustParseCIDRs(t, tt.allow...), mustParseCIDRs(t, tt.deny...)); ok != tt.ok {
+				t.Fatalf("allowed %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestMessageParseIPs(t *testing.T) {
+	m := message{AllowIPs: []string{"10.0.0.0/8"}, DenyIPs: []string{"10.0.0.1"}}
+	if err := m.parseIPs(); err != nil {
+		t.Fatal(err)
+	}
+	if !ipAllowed(net.ParseIP("10.0.0.2"), m.allowNets, m.denyNets) || ipAllowed(net.ParseIP("10.0.0.1"), m.allowNets, m.denyNets) {
+		t.Fatal("parsed lists not applied")
+	}
+	m.DenyIPs = []string{"10.0.0.1", "bad"}
+	if err := m.parseIPs(); err == nil {
+		t.Fatal("invalid item should fail")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func() { trustedProxyNets = nil }()
+	tests := []struct {
+		name    string
+		remote  string
+		xff     string
+		trusted []string
+		ip      string
+	}{
+		{"no proxy", "1.1.1.1", "2.2.2.2", nil, "1.1.1.1"},
+		{"untrusted proxy", "1.1.1.1", "2.2.2.2", []string{"10.0.0.0/8"}, "1.1.1.1"},
+		{"trusted proxy", "10.0.0.1", "2.2.2.2", []string{"10.0.0.0/8"}, "2.2.2.2"},
+		{"rightmost untrusted", "10.0.0.1", "3.3.3.3, 2.2.2.2, 10.0.0.2", []string{"10.0.0.0/8"}, "2.2.2.2"},
+		{"all trusted", "10.0.0.1", "10.0.0.3, 10.0.0.2", []string{"10.0.0.0/8"}, "10.0.0.3"},
+		{"no header", "10.0.0.1", "", []string{"10.0.0.0/8"}, "10.0.0.1"},
+		{"bad header", "10.0.0.1", "2.2.2.2, unknown", []string{"10.0.0.0/8"}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustedProxyNets = mustParseCIDRs(t, tt.trusted...)
+			var req fasthttp.Request
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP(tt.remote), Port: 1234}, nil)
+			if ip := clientIP(ctx); ip.String() != tt.ip {
+				t.Fatalf("ip %s, want %s", ip, tt.ip)
+			}
+		})
+	}
+}
+
+func TestClientAllowed(t *testing.T) {
+	allow := mustParseCIDRs(t, "10.0.0.0/8")
+	deny := mustParseCIDRs(t, "127.0.0.0/8")
+	tests := []struct {
+		name   string
+		remote net.Addr
+		ok     bool
+	}{
+		{"tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}, false},
+		{"tcp allowed", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}, true},
+		{"unix domain socket", &net.UnixAddr{Net: "unix"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Init(&fasthttp.Request{}, tt.remote, nil)
+			if _, ok := clientAllowed(ctx, allow, deny); ok != tt.ok {
+				t.Fatalf("allowed %v, want %v", ok, tt.ok)
+			}
+		})
+	}
+	//the peer of a real unix domain socket has no ip
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "wmq.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := make(chan bool, 1)
+	s := &fasthttp.Server{Handler: func(ctx *fasthttp.RequestCtx) {
+		_, ok := clientAllowed(ctx, allow, deny)
+		allowed <- ok
+	}}
+	go s.Serve(ln)
+	defer s.Shutdown()
+	c := &fasthttp.HostClient{Addr: "wmq", Dial: func(string) (net.Conn, error) { return net.Dial("unix", ln.Addr().String()) }}
+	if _, _, err = c.Get(nil, "http://wmq/"); err != nil {
+		t.Fatal(err)
+	}
+	if !<-allowed {
+		t.Fatal("client of unix domain socket should not be filtered by ip")
+	}
+}
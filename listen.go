@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	logger "github.com/snail007/mini-logger"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	certReloaders     []*certReloader
+	certReloadersLock = &sync.Mutex{}
+)
+
+//certReloader hold the certificate of a listener,
+//it's reloaded on SIGHUP or when the files were changed.
+type certReloader struct {
+	name         string
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	lock         *sync.RWMutex
+	cert         *tls.Certificate
+	clientCAs    *x509.CertPool
+}
+
+func newCertReloader(name, certFile, keyFile, clientCAFile string) (r *certReloader, err error) {
+	r = &certReloader{
+		name:         name,
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		lock:         &sync.RWMutex{},
+	}
+	if err = r.reload(); err != nil {
+		return nil, err
+	}
+	certReloadersLock.Lock()
+	certReloaders = append(certReloaders, r)
+	certReloadersLock.Unlock()
+	return
+}
+
+//reload load the files again,the old ones are kept when fail
+func (r *certReloader) reload() (err error) {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate %s fail,%s", r.certFile, err)
+	}
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		clientCAs, err = loadCertPool(r.clientCAFile)
+		if err != nil {
+			return
+		}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	return
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+//tlsConfig return config which always use the latest certificate
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			c := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+			}
+			if r.clientCAs != nil {
+				c.ClientCAs = r.clientCAs
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return c, nil
+		},
+	}
+}
+
+//listenerTLS return certReloader of listener name (api or publish) from config,
+//nil means plaintext.
+func listenerTLS(name string, allowClientCA bool) (r *certReloader, err error) {
+	certFile := cfg.GetString("listen." + name + "Cert")
+	keyFile := cfg.GetString("listen." + name + "Key")
+	clientCAFile := ""
+	if allowClientCA {
+		clientCAFile = cfg.GetString("listen." + name + "ClientCA")
+	}
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			err = fmt.Errorf("listen.%sClientCA requires listen.%sCert", name, name)
+		}
+		return
+	}
+	return newCertReloader(name, certFile, keyFile, clientCAFile)
+}
+
+//newListener listen on addr,it's wrapped with tls when r is not nil.
+//addr such as unix:/path/to.sock is an unix domain socket.
+func newListener(addr string, r *certReloader) (ln net.Listener, err error) {
+	if strings.HasPrefix(addr, "unix:") {
+		ln, err = listenUnix(strings.TrimPrefix(addr, "unix:"))
+	} else {
+		ln, err = net.Listen("tcp4", addr)
+	}
+	if err != nil {
+		return
+	}
+	if r != nil {
+		ln = tls.NewListener(ln, r.tlsConfig())
+	}
+	return
+}
+
+//listenUnix listen on unix domain socket path,the file mode is listen.socketMode
+func listenUnix(path string) (ln net.Listener, err error) {
+	mode, err := strconv.ParseUint(cfg.GetString("listen.socketMode"), 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("listen.socketMode should be octal such as 0660,%s", err)
+	}
+	if pathExists(path) {
+		//remove the socket left by last run,but not the one in use
+		if c, e := net.Dial("unix", path); e == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return
+		}
+	}
+	ln, err = net.Listen("unix", path)
+	if err != nil {
+		return
+	}
+	if err = os.Chmod(path, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return
+}
+
+//serve s on address listen
+func serve(s *fasthttp.Server, listen string, r *certReloader) (err error) {
+	ln, err := newListener(listen, r)
+	if err != nil {
+		return
+	}
+	return s.Serve(ln)
+}
+
+//reloadCerts reload certificates of all listeners
+func reloadCerts() {
+	certReloadersLock.Lock()
+	defer certReloadersLock.Unlock()
+	for _, r := range certReloaders {
+		ctx := ctxFunc("reloadCerts").With(logger.Fields{"listener": r.name})
+		if err := r.reload(); err != nil {
+			ctx.Warnf("fail, keep the old one, %s", err)
+		} else {
+			ctx.Infof("reloaded")
+		}
+	}
+}
+
+//watchCerts reload certificates on SIGHUP or when the files were changed
+func watchCerts() (err error) {
+	ctx := ctxFunc("watchCerts")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			ctx.Infof("SIGHUP received")
+			reloadCerts()
+		}
+	}()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return
+	}
+	files := map[string]bool{}
+	certReloadersLock.Lock()
+	for _, r := range certReloaders {
+		for _, f := range r.files() {
+			f, _ = filepath.Abs(f)
+			files[f] = true
+			//watch the directory,certificates are usually replaced by rename
+			if err = watcher.Add(filepath.Dir(f)); err != nil {
+				certReloadersLock.Unlock()
+				watcher.Close()
+				return
+			}
+		}
+	}
+	certReloadersLock.Unlock()
+	go func() {
+		defer watcher.Close()
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !files[filepath.Clean(event.Name)] ||
+					event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(dataFileWatchDelay, reloadCerts)
+			case e, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				ctx.Warnf("watch fail, %s", e)
+			}
+		}
+	}()
+	return
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	defer cfg.Set("listen.socketMode", nil)
+	tests := []struct {
+		name string
+		mode string
+		//prepare the path before listening,return cleanup
+		prepare func(t *testing.T, path string) func()
+		ok      bool
+	}{
+		{"new", "0660", func(t *testing.T, path string) func() { return func() {} }, true},
+		{"mode", "0600", func(t *testing.T, path string) func() { return func() {} }, true},
+		{"bad mode", "rw", func(t *testing.T, path string) func() { return func() {} }, false},
+		{"stale socket", "0660", func(t *testing.T, path string) func() {
+			ln, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			//the socket file is left as a crashed wmq does
+			ln.(*net.UnixListener).SetUnlinkOnClose(false)
+			ln.Close()
+			return func() {}
+		}, true},
+		{"in use", "0660", func(t *testing.T, path string) func() {
+			ln, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return func() { ln.Close() }
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wmq.sock")
+			cfg.Set("listen.socketMode", tt.mode)
+			defer tt.prepare(t, path)()
+			ln, err := listenUnix(path)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok %v", err, tt.ok)
+			}
+			if err != nil {
+				return
+			}
+			defer ln.Close()
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mode, _ := strconv.ParseUint(tt.mode, 8, 32)
+			if info.Mode().Perm() != os.FileMode(mode) {
+				t.Fatalf("mode %s, want %s", info.Mode().Perm(), os.FileMode(mode))
+			}
+			c, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatalf("dial fail, %s", err)
+			}
+			c.Close()
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+//compiledCacheSize max compiled filters or templates kept in memory
+const compiledCacheSize = 1024
+
+//lruCache is a string keyed cache,the least recently used item is removed
+//when it's full
+type lruCache struct {
+	max   int
+	lock  *sync.Mutex
+	items map[string]*list.Element
+	order *list.List
+}
+
+type lruItem struct {
+	key   string
+	value interface{}
+}
+
+func newLRUCache(max int) *lruCache {
+	return &lruCache{
+		max:   max,
+		lock:  &sync.Mutex{},
+		items: map[string]*list.Element{},
+		order: list.New(),
+	}
+}
+
+func (c *lruCache) get(key string) (value interface{}, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruItem).value, true
+}
+
+func (c *lruCache) add(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[key]; ok {
+		e.Value.(*lruItem).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruItem{key: key, value: value})
+	for c.order.Len() > c.max {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*lruItem).key)
+	}
+}
+
+func (c *lruCache) remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.order.Remove(e)
+		delete(c.items, key)
+	}
+}
+
+func (c *lruCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.add("a", 1)
+	c.add("b", 2)
+	//a is used,so b is the least recently used one
+	if v, ok := c.get("a"); !ok || v != 1 {
+		t.Fatalf("get a %v,%v", v, ok)
+	}
+	c.add("c", 3)
+	tests := []struct {
+		key   string
+		value interface{}
+		ok    bool
+	}{
+		{"a", 1, true},
+		{"b", nil, false},
+		{"c", 3, true},
+	}
+	for _, tt := range tests {
+		if v, ok := c.get(tt.key); ok != tt.ok || v != tt.value {
+			t.Fatalf("get %s %v,%v, want %v,%v", tt.key, v, ok, tt.value, tt.ok)
+		}
+	}
+	c.add("c", 4)
+	if v, _ := c.get("c"); v != 4 || c.len() != 2 {
+		t.Fatalf("replace c %v,len %d", v, c.len())
+	}
+	c.remove("a")
+	c.remove("missing")
+	if _, ok := c.get("a"); ok || c.len() != 1 {
+		t.Fatalf("remove a,len %d", c.len())
+	}
+}
+
+func TestTemplateCache(t *testing.T) {
+	text := `{{.Body}}-cached`
+	tr := &transform{Body: text}
+	if err := tr.check(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := templateCache.get(text); ok {
+		t.Fatal("template being checked should not be cached")
+	}
+	if s, err := renderTemplate("Body", text, map[string]interface{}{"Body": "x"}); err != nil || s != "x-cached" {
+		t.Fatalf("render %q,%v", s, err)
+	}
+	if _, ok := templateCache.get(text); !ok {
+		t.Fatal("template of delivery should be cached")
+	}
+	consumer{Transform: tr}.forgetCompiled()
+	if _, ok := templateCache.get(text); ok {
+		t.Fatal("template should be removed when consumer is updated")
+	}
+	for i := 0; i < compiledCacheSize+10; i++ {
+		renderTemplate("Body", "{{.Body}}"+strconv.Itoa(i), nil)
+	}
+	if n := templateCache.len(); n != compiledCacheSize {
+		t.Fatalf("cache size %d, want %d", n, compiledCacheSize)
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"reflect"
+	"regexp"
 	"strconv"
 	"time"
 
@@ -19,7 +21,6 @@ import (
 	"github.com/Jeffail/gabs"
 	logger "github.com/snail007/mini-logger"
 	"github.com/streadway/amqp"
-	"github.com/valyala/fasthttp"
 )
 
 type message struct {
@@ -30,6 +31,29 @@ type message struct {
 	Name        string
 	Token       string
 	Comment     string
+	AllowIPs    []string
+	DenyIPs     []string
+	Tokens      []messageToken
+	//MaxBodyBytes 0 means no limit except publish.MaxBodyBytes
+	MaxBodyBytes int64
+	//ContentTypes allowed media types of publishing,empty means all
+	ContentTypes []string
+	//JSONSchema body should be valid against it when it's set
+	JSONSchema map[string]interface{}
+	//Bindings route messages to other messages
+	Bindings []messageBinding
+	//ReplyConsumer is the ID of consumer whose response is returned to
+	//the publisher waiting for it,empty means request/reply is disabled
+	ReplyConsumer string
+	//IdempotencyWindow seconds to keep Idempotency-Key of publishing,0 means disabled
+	IdempotencyWindow int64
+	//MaxPriority of consumers' queues,0 means priority is disabled
+	MaxPriority int
+	//allowNets and denyNets are parsed from AllowIPs and DenyIPs by parseIPs
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+	//schemaPatterns are compiled from patterns of JSONSchema by parseSchema
+	schemaPatterns map[string]*regexp.Regexp
 }
 type consumer struct {
 	ID        string
@@ -39,25 +63,88 @@ type consumer struct {
 	Code      float64
 	CheckCode bool
 	Comment   string
+	Paused    bool
+	//Transform nil means the request is sent unchanged
+	Transform *transform
+	//Filter empty means all deliveries are sent to URL
+	Filter string
+	//HeadersMatch is used instead of RouteKey when message's mode is headers
+	HeadersMatch *headersMatch
+	//Batch nil means one request per delivery
+	Batch *batch
+	//Partition nil means deliveries are processed one by one
+	Partition *partition
+	//CircuitBreaker nil means consuming never stops when URL keeps failing
+	CircuitBreaker *circuitBreaker
+	//RateLimit nil means requests to URL are not limited
+	RateLimit *rateLimit
+}
+
+//headersMatch is the binding of consumer to headers exchange,
+//XMatch all means every header should match,any means one of them.
+type headersMatch struct {
+	XMatch  string
+	Headers map[string]string
+}
+
+//bindArgs return the arguments to bind consumer's queue,
+//header names are lower case,so they are case insensitive.
+func (c consumer) bindArgs() amqp.Table {
+	if c.HeadersMatch == nil {
+		return nil
+	}
+	xMatch := c.HeadersMatch.XMatch
+	if xMatch == "" {
+		xMatch = "all"
+	}
+	args := amqp.Table{"x-match": xMatch}
+	for k, v := range c.HeadersMatch.Headers {
+		args[strings.ToLower(k)] = v
+	}
+	return args
+}
+
+//maxPriority is the max x-max-priority supported by RabbitMQ
+const maxPriority = 255
+
+//queueArgs return the arguments to declare consumers' queues of message,
+//queue is deleted and declared again when they were changed.
+func (m message) queueArgs() amqp.Table {
+	if m.MaxPriority <= 0 {
+		return nil
+	}
+	return amqp.Table{"x-max-priority": int32(m.MaxPriority)}
+}
+
+//bindingChanged return true when the binding of consumer should be recreated
+func bindingChanged(oc, nc consumer) bool {
+	return oc.RouteKey != nc.RouteKey || !reflect.DeepEqual(oc.bindArgs(), nc.bindArgs())
 }
 
 var (
 	msgLock = &sync.Mutex{}
+	//dataFileContent is the content last written to data file by wmq,guarded by msgLock,
+	//the watcher should not reload it.
+	dataFileContent string
 )
 
 func parseMessages(str string) (messages []message, err error) {
-	defer func(err *error) {
-		e := recover()
-		if e != nil {
-			*err = fmt.Errorf("%s", e)
+	err = json.Unmarshal([]byte(str), &messages)
+	if err != nil {
+		err = fmt.Errorf("parse messages fail,%s", err)
+		return
+	}
+	err = validateMessages(messages)
+	if err != nil {
+		return
+	}
+	for i := range messages {
+		if err = messages[i].parseIPs(); err != nil {
+			return
+		}
+		if err = messages[i].parseSchema(); err != nil {
+			return
 		}
-	}(&err)
-	jsonData, _ := gabs.ParseJSON([]byte(str))
-	msgs, _ := jsonData.Children()
-	for _, m := range msgs {
-		msg := message{}
-		json.Unmarshal(m.Bytes(), &msg)
-		messages = append(messages, msg)
 	}
 	return
 }
@@ -139,11 +226,8 @@ func statusConsumer(messageName, consumerID string) (json *gabs.Container, err e
 	}
 	m := messages[i]
 	var q amqp.Queue
-	//var ch *amqp.Channel
-	//ch, _ = getMqChannel()
-	//q, e = ch.QueueDeclare(getConsumerKey(m, *c), m.Durable, !m.Durable, false, false, nil)
-	//defer channelPools.Put(ch)
-	q, _, e = queueDeclare(getConsumerKey(m, *c), m.Durable)
+	//passive,declaring with changed arguments would delete the queue
+	q, e = queueInspect(getConsumerKey(m, *c))
 	if e != nil {
 		return nil, e
 	}
@@ -152,10 +236,16 @@ func statusConsumer(messageName, consumerID string) (json *gabs.Container, err e
 	jsonObj.Set(count, "Count")
 	jsonObj.Set(consumerID, "ID")
 	jsonObj.Set(messageName, "MsgName")
+	jsonObj.Set(c.Paused, "Paused")
 	jsonObj.Set("0", "LastTime")
-	lasttime, e := statusConsumerWorker(*c, m)
+	answer, e := statusConsumerWorker(*c, m)
 	if e == nil {
-		jsonObj.Set(lasttime, "LastTime")
+		if stats, e := gabs.ParseJSON([]byte(answer)); e == nil {
+			children, _ := stats.ChildrenMap()
+			for k, v := range children {
+				jsonObj.Set(v.Data(), k)
+			}
+		}
 	}
 	//jsonObj.StringIndent("", "  ")
 	//json = jsonObj.String()
@@ -164,6 +254,12 @@ func statusConsumer(messageName, consumerID string) (json *gabs.Container, err e
 }
 func addMessage(m message) (err error) {
 	ctx := ctxFunc("addMessage")
+	if err = m.parseIPs(); err != nil {
+		return
+	}
+	if err = m.parseSchema(); err != nil {
+		return
+	}
 	msgLock.Lock()
 	defer msgLock.Unlock()
 	messages = append(messages, m)
@@ -173,6 +269,12 @@ func addMessage(m message) (err error) {
 }
 func updateMessage(m message) (err error) {
 	ctx := ctxFunc("updateMessage")
+	if err = m.parseIPs(); err != nil {
+		return
+	}
+	if err = m.parseSchema(); err != nil {
+		return
+	}
 	msgLock.Lock()
 	defer msgLock.Unlock()
 	_, i, e := getMessage(m.Name)
@@ -227,6 +329,7 @@ func deleteMessage(m message) (err error) {
 	}
 	//update messsages data
 	messages = append(messages[:i], messages[i+1:]...)
+	removeBindingsTo(m.Name)
 	ctx.Infof("deleted")
 	initMessages()
 	return
@@ -257,6 +360,7 @@ func updateConsumer(msg message, c0 consumer) (err error) {
 		return e
 	}
 	//update messages data
+	messages[i].Consumers[k].forgetCompiled()
 	messages[i].Consumers[k] = c0
 
 	//update consumer worker
@@ -264,6 +368,29 @@ func updateConsumer(msg message, c0 consumer) (err error) {
 	return
 }
 
+//pauseConsumer stop consuming but keep the queue,paused state is kept in messages
+func pauseConsumer(msg message, c0 consumer, paused bool) (err error) {
+	ctx := ctxFunc("pauseConsumer")
+	msgLock.Lock()
+	defer msgLock.Unlock()
+	_, i, k, e := getConsumer(msg.Name, c0.ID)
+	if e != nil {
+		return e
+	}
+	messages[i].Consumers[k].Paused = paused
+	c0.Paused = paused
+	if paused {
+		_, err = pauseConsumerWorker(c0, msg)
+	} else {
+		_, err = resumeConsumerWorker(c0, msg)
+	}
+	if err != nil {
+		return
+	}
+	ctx.With(logger.Fields{"consumer": getConsumerKey(msg, c0)}).Infof("paused: %v", paused)
+	return
+}
+
 func deleteConsumer(msg message, c0 consumer) (err error) {
 	ctx := ctxFunc("deleteConsumer")
 	msgLock.Lock()
@@ -274,7 +401,11 @@ func deleteConsumer(msg message, c0 consumer) (err error) {
 		return
 	}
 	//delete messages consumer
+	messages[i0].Consumers[i].forgetCompiled()
 	messages[i0].Consumers = append(messages[i0].Consumers[:i], messages[i0].Consumers[i+1:]...)
+	if messages[i0].ReplyConsumer == c0.ID {
+		messages[i0].ReplyConsumer = ""
+	}
 	//stop consumer
 	_, err = stopConsumerWorker(c0, msg)
 	if err != nil {
@@ -297,14 +428,15 @@ func deleteConsumer(msg message, c0 consumer) (err error) {
 	return
 }
 
-func publish(body, exchangeName, routeKey, token string) (err error) {
+//publish headers are used for routing of headers exchange
+func publish(body, exchangeName, routeKey, token string, headers amqp.Table, priority uint8) (err error) {
 	ctx := ctxFunc("publish")
 	var msg *message
 	msg, _, err = getMessage(exchangeName)
 	if err != nil {
 		return
 	}
-	if msg.IsNeedToken && token != msg.Token {
+	if _, ok := msg.checkToken(token); !ok {
 		err = errors.New("token error")
 		return
 	}
@@ -312,7 +444,9 @@ func publish(body, exchangeName, routeKey, token string) (err error) {
 	channel, err = getMqChannel()
 	if err == nil {
 		err = channel.Publish(getExchangeName(exchangeName), routeKey, false, false, amqp.Publishing{
-			Body: []byte(body),
+			Headers:  headers,
+			Priority: priority,
+			Body:     []byte(body),
 		})
 		channelPools.Put(channel)
 		ctx1 := ctx.With(logger.Fields{"call": "channel.Publish", "exchange": getExchangeName(exchangeName)})
@@ -342,6 +476,7 @@ type manageConsumer struct {
 	consumerReadChan  chan string
 	consumerWriteChan chan string
 	key               string
+	stats             *consumerStats
 }
 
 var consumerManageReadChan, consumerManageWriteChan = make(chan wrapedConsumer, 1), make(chan string, 1)
@@ -355,9 +490,15 @@ func stopConsumerWorker(c consumer, m message) (answer string, err error) {
 func statusConsumerWorker(c consumer, m message) (answer string, err error) {
 	return notifyConsumerManager("status", c, m)
 }
+func pauseConsumerWorker(c consumer, m message) (answer string, err error) {
+	return notifyConsumerManager("pause", c, m)
+}
+func resumeConsumerWorker(c consumer, m message) (answer string, err error) {
+	return notifyConsumerManager("resume", c, m)
+}
 func notifyConsumerManager(action string, c consumer, m message) (answer string, err error) {
-	if action != "update" && action != "delete" && action != "status" {
-		err = fmt.Errorf("action must be [update|delete]")
+	if ok, _ := inArray(action, []string{"update", "delete", "status", "pause", "resume"}); !ok {
+		err = fmt.Errorf("action must be [update|delete|status|pause|resume]")
 		return
 	}
 	ctx := ctxFunc("notifyConsumerManager").With(logger.Fields{"action": action, "message": "m.Name", "consumer": c.ID})
@@ -372,6 +513,34 @@ func notifyConsumerManager(action string, c consumer, m message) (answer string,
 	ctx.Debugf("consumer manager answer : %s", answer)
 	return
 }
+//wakeConsumerWorker wake up the worker waiting for command,
+//the worker reload its item,so the command can be dropped when one is pending.
+func wakeConsumerWorker(item manageConsumer, cmd string) {
+	select {
+	case item.consumerReadChan <- cmd:
+	default:
+	}
+}
+
+//touchConsumer update consumer active time and return the latest item,
+//ok is false when the consumer is deleted or added again for a new worker,
+//the worker is told by it's consumerReadChan which is kept on update.
+func touchConsumer(wrapedConsumers ConcurrentMap, key string, readChan chan string) (item manageConsumer, ok bool) {
+	shard := wrapedConsumers.GetShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	v, exists := shard.items[key]
+	if !exists {
+		return
+	}
+	item = v.(manageConsumer)
+	if item.consumerReadChan != readChan {
+		return item, false
+	}
+	item.lasttime = time.Now().Unix()
+	shard.items[key] = item
+	return item, true
+}
 func getConsumerKey(m message, c consumer) string {
 	return m.Name + "-" + c.ID
 }
@@ -386,13 +555,13 @@ func initMessages() (err error) {
 			return
 		}
 		for _, c := range m.Consumers {
-			_, _, err = queueDeclare(getConsumerKey(m, c), m.Durable)
+			_, _, err = queueDeclare(getConsumerKey(m, c), m.Durable, m.queueArgs())
 			ctx2 := ctx1.With(logger.Fields{"queue": getConsumerKey(m, c)})
 			if err != nil {
 				ctx2.Warnf("declare fail , %s ", err)
 				return
 			}
-			err = queueBindToExchange(getConsumerKey(m, c), m.Name, c.RouteKey)
+			err = queueBindToExchange(getConsumerKey(m, c), m.Name, c.RouteKey, c.bindArgs())
 			if err != nil {
 				ctx2.Warnf("bind fail , %s ", err)
 				return
@@ -406,6 +575,10 @@ func initMessages() (err error) {
 			ctx3.Debugf("answer %s ", answer)
 		}
 	}
+	err = bindMessages(messages)
+	if err != nil {
+		ctx.Warnf("bind fail , %s ", err)
+	}
 	return
 }
 func restart() (err error) {
@@ -456,26 +629,50 @@ func initConsumerManager() {
 			switch wrapedConsumer.action {
 			case "update": //update or insert consumer
 				t := "update"
+				newItem := manageConsumer{
+					wrapedConsumer:    wrapedConsumer,
+					consumerReadChan:  make(chan string, 1),
+					consumerWriteChan: make(chan string, 1),
+					key:               key,
+					stats:             newConsumerStats(),
+				}
 				if item, ok := wrapedConsumers.Get(key); !ok {
 					t = "insert"
 				} else {
+					//keep the channels of running worker,it may be waiting on them
 					_item := item.(manageConsumer)
-					_item.lasttime = time.Now().Unix()
-					wrapedConsumers.Set(key, _item)
+					newItem.consumerReadChan = _item.consumerReadChan
+					newItem.consumerWriteChan = _item.consumerWriteChan
+					newItem.stats = _item.stats
+					newItem.lasttime = time.Now().Unix()
 				}
+				newItem.stats.setRateLimit(wrapedConsumer.consumer.RateLimit)
 				ctx1.Debugf("%s", t)
-				wrapedConsumers.Set(key, manageConsumer{
-					wrapedConsumer:    wrapedConsumer,
-					consumerReadChan:  make(chan string, 1),
-					consumerWriteChan: make(chan string, 1),
-					key:               key,
-				})
+				wrapedConsumers.Set(key, newItem)
+				if t == "update" {
+					wakeConsumerWorker(newItem, "update")
+				}
 				if t == "insert" {
 					//start consumer go
-					go func() {
+					go func(stats *consumerStats, readChan chan string) {
 						var channel *amqp.Channel
+						//b holds deliveries of batch consumer
+						b := &batcher{}
+						//parts process deliveries of partition consumer
+						var parts *partitioner
+						stopPartitions := func() {
+							if parts != nil {
+								parts.stop()
+								parts = nil
+							}
+						}
 						defer func() {
-							wrapedConsumers.Remove(key)
+							stopPartitions()
+							stats.setState(stateStopped)
+							//the consumer may be added again for a new worker,leave it
+							wrapedConsumers.RemoveCb(key, func(key string, v interface{}, exists bool) bool {
+								return exists && v.(manageConsumer).consumerReadChan == readChan
+							})
 							if channel != nil {
 								channel.Close()
 								ctx1.Warnf("channel %s closed ", key)
@@ -485,21 +682,52 @@ func initConsumerManager() {
 						//0.consumer worker start
 						for {
 						RETRY:
-							//1.check if exists in wrapedConsumers data
-							if _, ok := wrapedConsumers.Get(key); !ok {
+							//1.check if exists in wrapedConsumers data,and update consumer active time
+							_item, ok := touchConsumer(wrapedConsumers, key, readChan)
+							if !ok {
 								ctx1.Warnf("not found , now exit")
 								runtime.Goexit()
 							}
-							//update consumer active time
-							item, _ := wrapedConsumers.Get(key)
-							_item := item.(manageConsumer)
-							_item.lasttime = time.Now().Unix()
-							wrapedConsumers.Set(key, _item)
+							if isShuttingDown() {
+								ctx1.Infof("shutting down , now exit")
+								runtime.Goexit()
+							}
+							//paused consumer waiting for resume,queue keeps accumulating messages
+							if _item.consumer.Paused {
+								stats.setState(statePaused)
+								ctx1.Infof("paused")
+								select {
+								case cmd := <-_item.consumerReadChan:
+									if cmd == "exit" {
+										_item.consumerWriteChan <- "exit_ok"
+										runtime.Goexit()
+									}
+								case <-shutdownChan:
+								}
+								continue
+							}
+							//open circuit waiting for probing,queue keeps accumulating messages
+							if wait := stats.circuitCheck(_item.consumer.CircuitBreaker); wait > 0 {
+								stats.setState(stateCircuitOpen)
+								ctx1.Warnf("circuit open , stop consuming for %s", wait)
+								select {
+								case cmd := <-_item.consumerReadChan:
+									if cmd == "exit" {
+										_item.consumerWriteChan <- "exit_ok"
+										runtime.Goexit()
+									}
+								case <-time.After(wait):
+								case <-shutdownChan:
+								}
+								continue
+							}
+							stats.setState(stateConnecting)
 							//2.try get connection
 							conn, err := pools.Get()
 							if err != nil {
 								pools.Put(conn)
 								ctx1.With(logger.Fields{"call": "pools.Get"}).Warnf(errStr+"%s", err)
+								stats.setState(stateRetrying)
 								time.Sleep(time.Second * waitSeconds)
 								continue
 							}
@@ -508,123 +736,243 @@ func initConsumerManager() {
 							if err != nil {
 								pools.Put(conn)
 								ctx1.With(logger.Fields{"call": "pools.Put"}).Warnf(errStr+"%s", err)
+								stats.setState(stateRetrying)
 								time.Sleep(time.Second * waitSeconds)
 								continue
 							}
 							//4.try  declare exchange  on channel
-							item, _ = wrapedConsumers.Get(key)
-							_item = item.(manageConsumer)
+							if _item, ok = touchConsumer(wrapedConsumers, key, readChan); !ok {
+								pools.Put(conn)
+								ctx1.Warnf("not found , now exit")
+								runtime.Goexit()
+							}
 							_, err = exchangeDeclare(_item.message.Name,
 								_item.message.Mode,
 								_item.message.Durable)
 							if err != nil {
 								pools.Put(conn)
 								ctx1.With(logger.Fields{"call": "exchangeDeclare"}).Warnf(errStr+"%s", err)
+								stats.setState(stateRetrying)
 								time.Sleep(time.Second * waitSeconds)
 								continue
 							}
 							//5.try  declare queue  on channel
 							_, _, err = queueDeclare(getConsumerKey(_item.message, _item.consumer),
-								_item.message.Durable)
+								_item.message.Durable, _item.message.queueArgs())
 							if err != nil {
 								pools.Put(conn)
 								ctx1.With(logger.Fields{"call": "queueDeclare"}).Warnf("fail,", key, err)
+								stats.setState(stateRetrying)
 								time.Sleep(time.Second * waitSeconds)
 								continue
 							}
 							//6.try  bind queue to exchange
 							err = queueBindToExchange(getConsumerKey(_item.message, _item.consumer),
 								_item.message.Name,
-								_item.consumer.RouteKey)
+								_item.consumer.RouteKey,
+								_item.consumer.bindArgs())
 							if err != nil {
 								pools.Put(conn)
 								ctx1.With(logger.Fields{"call": "queueBindToExchange"}).Warnf(errStr+"%s", err)
+								stats.setState(stateRetrying)
 								time.Sleep(time.Second * waitSeconds)
 								continue
 							}
 							//7.try  set qos on channel
-							err = channel.Qos(1, 0, false)
+							prefetch := _item.consumer.prefetch()
+							err = channel.Qos(prefetch, 0, false)
 							if err != nil {
 								pools.Put(conn)
 								ctx1.With(logger.Fields{"call": "channel.Qos"}).Warnf(errStr+"%s", err)
+								stats.setState(stateRetrying)
 								time.Sleep(time.Second * waitSeconds)
 								continue
 							}
 							//8.try consume queue
-							deliveryChn, err := channel.Consume(getQueueName(key), "", false, false, false, false, nil)
+							deliveryChn, err := channel.Consume(getQueueName(key), key, false, false, false, false, nil)
 							if err != nil {
 								pools.Put(conn)
 								ctx1.With(logger.Fields{"call": "channel.Consume"}).Warnf(errStr+"%s", err)
+								stats.setState(stateRetrying)
 								time.Sleep(time.Second * waitSeconds)
 								continue
 							}
+							if _item.consumer.Partition != nil {
+								c0 := _item.consumer
+								parts = newPartitioner(c0.Partition.Concurrency, prefetch, func() consumer {
+									if item, ok := wrapedConsumers.Get(key); ok {
+										return item.(manageConsumer).consumer
+									}
+									return c0
+								}, stats, ctx1)
+							}
+							stats.setState(stateConsuming)
 							ctx1.Infof("waiting for message ...")
 							//worker loop,use chan waiting for control command or delivery
 							for {
-								if _, ok := wrapedConsumers.Get(key); !ok {
+								//update consumer active time
+								_item, ok := touchConsumer(wrapedConsumers, key, readChan)
+								if !ok {
+									pools.Put(conn)
 									ctx1.Warnf("not found , now exit")
 									runtime.Goexit()
 								}
-								//update consumer active time
-								item, _ := wrapedConsumers.Get(key)
-								_item := item.(manageConsumer)
-								_item.lasttime = time.Now().Unix()
-								wrapedConsumers.Set(key, _item)
+								//qos should be set again when batch size or partitions changed
+								if _item.consumer.Paused || _item.consumer.prefetch() != prefetch ||
+									(_item.consumer.Partition == nil) != (parts == nil) ||
+									stats.circuitCheck(_item.consumer.CircuitBreaker) > 0 {
+									//cancel subscription,unacked deliveries are requeued when channel closed
+									if err = channel.Cancel(key, false); err != nil {
+										ctx1.Warnf("cancel fail , %s", err)
+									}
+									stopPartitions()
+									channel.Close()
+									b.reset()
+									pools.Put(conn)
+									goto RETRY
+								}
+								//partition lanes fail without waking up the worker,so check circuit periodically
+								var circuitTick <-chan time.Time
+								if _item.consumer.CircuitBreaker != nil && parts != nil {
+									circuitTick = time.After(time.Second)
+								}
 								select {
+								case <-circuitTick:
 								case cmd := <-_item.consumerReadChan:
 									if cmd == "exit" {
+										b.reset()
 										pools.Put(conn)
 										_item.consumerWriteChan <- "exit_ok"
 										runtime.Goexit()
 									}
+								case <-shutdownChan:
+									//cancel subscription,unacked deliveries are requeued when channel closed
+									if err = channel.Cancel(key, false); err != nil {
+										ctx1.Warnf("cancel fail , %s", err)
+									}
+									//send the pending batch,shutdown is waiting for it
+									if b.len() > 0 {
+										b.send(_item.consumer, stats, nil, ctx1)
+									}
+									pools.Put(conn)
+									ctx1.Infof("shutting down , now exit")
+									runtime.Goexit()
+								case <-b.wait():
+									sleepOrShutdown(b.send(_item.consumer, stats, _item.consumerReadChan, ctx1))
+									stats.setState(stateConsuming)
 								case delivery, ok := <-deliveryChn:
 									if !ok {
+										b.reset()
+										stopPartitions()
 										pools.Put(conn)
 										ctx1.Warnf("read deliveryChn fail")
 										goto RETRY
 									}
+									//batch is in-flight from the first delivery until it's sent
+									if b.len() == 0 && !beginDelivery() {
+										delivery.Nack(false, true)
+										continue
+									}
+									if parts != nil {
+										parts.dispatch(partitionKey(_item.consumer.Partition.Key, string(delivery.Body)), delivery)
+										continue
+									}
+									if _item.consumer.Batch != nil {
+										//the batch is cut to the room of probes while the circuit is half-open
+										full := b.add(delivery, _item.consumer)
+										if room := stats.circuitRoom(_item.consumer.CircuitBreaker); room >= 0 && b.len() >= room {
+											full = true
+										}
+										if full {
+											sleepOrShutdown(b.send(_item.consumer, stats, _item.consumerReadChan, ctx1))
+											stats.setState(stateConsuming)
+										}
+										continue
+									}
 									//body := string(delivery.Body)[0:50] + "..."
 									body := string(delivery.Body)
 									ctx1.Debugf("delivery revecived: %s,%s", key, body)
-									if process(string(delivery.Body), _item.consumer) == nil {
+									var sleep time.Duration
+									if !stats.throttle(_item.consumer.RateLimit, nil, _item.consumerReadChan) {
+										//shutting down or worker is told to pause,update or exit,
+										//requeue it and check the consumer again
+										delivery.Nack(false, true)
+										endDelivery()
+										continue
+									}
+									start := time.Now()
+									code, dropped, err := process(string(delivery.Body), _item.consumer)
+									if dropped {
+										//nothing is sent,the token is for the next delivery
+										stats.returnToken(_item.consumer.RateLimit)
+									}
+									if err == errFiltered {
+										stats.filtered()
+										err = nil
+									} else if dropped {
+										stats.dropped(err)
+										err = nil
+									} else if err == nil {
+										stats.delivered(1, code, time.Since(start))
+									} else {
+										stats.failed(1, code, err, time.Since(start))
+									}
+									if err == nil {
 										//process success
 										err = delivery.Ack(false)
 										if err != nil {
 											ctx1.Warnf("ack fail , %s", err)
-											time.Sleep(time.Second * waitSeconds)
+											sleep = time.Second * waitSeconds
 										}
 									} else {
 										//process fail
 										err = delivery.Nack(false, true)
 										if err != nil {
 											ctx1.Warnf("nack fail , %s", err)
-											time.Sleep(time.Second * waitSeconds)
+											sleep = time.Second * waitSeconds
 										} else {
-											time.Sleep(time.Second * waitSeconds1)
+											sleep = time.Second * waitSeconds1
 										}
+										stats.setState(stateRetrying)
 									}
+									endDelivery()
+									sleepOrShutdown(sleep)
+									stats.setState(stateConsuming)
 								}
 							}
 						}
-					}()
+					}(newItem.stats, newItem.consumerReadChan)
 				}
 				consumerManageWriteChan <- "completed"
 			case "delete": //stop consumer
-				if item, ok := wrapedConsumers.Get(key); ok {
+				//remove it at once,so the consumer added again gets a new worker,
+				//the old worker exits when it's woken up or the delivery in hand is done
+				if item, ok := wrapedConsumers.Pop(key); ok {
 					_item := item.(manageConsumer)
 					ctx1.Debugf("sending stop singal to goroutine ...")
-					_item.consumerReadChan <- "exit"
+					wakeConsumerWorker(_item, "exit")
 					ctx1.Debugf("send  stop singal to goroutine success")
 				}
 				consumerManageWriteChan <- "completed"
-			case "status": //get consumer last active time
+			case "pause", "resume": //pause or resume consumer,queue keeps accumulating messages
+				if item, ok := wrapedConsumers.Get(key); ok {
+					_item := item.(manageConsumer)
+					_item.consumer.Paused = wrapedConsumer.action == "pause"
+					wrapedConsumers.Set(key, _item)
+					wakeConsumerWorker(_item, wrapedConsumer.action)
+				}
+				consumerManageWriteChan <- "completed"
+			case "status": //get consumer last active time and stats
 				v, ok := wrapedConsumers.Get(key)
-				var t int64
+				stats := gabs.New()
+				stats.Set(stateStopped, "State")
+				stats.Set("0", "LastTime")
 				if ok {
 					_v := v.(manageConsumer)
-					t = _v.lasttime
+					stats, _ = gabs.ParseJSON([]byte(_v.stats.String()))
+					stats.Set(fmt.Sprintf("%d", _v.lasttime), "LastTime")
 				}
-				consumerManageWriteChan <- fmt.Sprintf("%d", t)
+				consumerManageWriteChan <- stats.String()
 			default:
 				consumerManageWriteChan <- "unkown command"
 			}
@@ -637,7 +985,17 @@ func writeMessagesToFile(messages0 []message, configFilePath0 string) (err error
 	b, err := json.Marshal(messages0)
 	c, err := gabs.ParseJSON(b)
 	content := c.StringIndent("", "	")
-	err = ioutil.WriteFile(configFilePath0, []byte(content), 0600)
+	//write a temp file and rename it,so the watcher and a crash never see a partial file
+	tmp := configFilePath0 + ".tmp"
+	err = ioutil.WriteFile(tmp, []byte(content), 0600)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp, configFilePath0)
+	if err != nil {
+		return
+	}
+	dataFileContent = content
 	return
 }
 func loadMessagesFromFile(configFilePath0 string) (messages0 []message, err error) {
@@ -645,6 +1003,9 @@ func loadMessagesFromFile(configFilePath0 string) (messages0 []message, err erro
 	defer msgLock.Unlock()
 	if _, err := os.Stat(configFilePath0); os.IsNotExist(err) {
 		err = ioutil.WriteFile(configFilePath0, []byte("[]"), 0600)
+		if err == nil {
+			dataFileContent = "[]"
+		}
 	} else {
 		var content string
 		content, err = fileGetContents(configFilePath0)
@@ -652,86 +1013,74 @@ func loadMessagesFromFile(configFilePath0 string) (messages0 []message, err erro
 			messages0, err = parseMessages(content)
 			if err == nil {
 				messages = messages0
+				//the watcher ignores the file until it's changed
+				dataFileContent = content
 			}
 		}
 	}
 	return
 }
 
-func process(content string, c consumer) (err error) {
+//process send the delivery to consumer's URL,
+//dropped means the delivery is not supported and should be acked.
+func process(content string, c consumer) (code int, dropped bool, err error) {
 	ctx := ctxFunc("process")
 	//content = "{\"body\":\"sss\",\"header\":{\"ID\":\"test\"},\"ip\":\"127.0.0.1\",\"method\":\"get\"}"
 
-	jsonParsed, err := gabs.ParseJSON([]byte(content))
-	ctx1 := ctx.With(logger.Fields{"call": "gabs.ParseJSON"})
+	e, err := parseEnvelope(content)
 	if err != nil {
-		ctx1.Warnf("message from rabbitmq not suppported and drop it, msg : %s", content[:20])
-		return nil
+		ctx.With(logger.Fields{"call": "parseEnvelope"}).Warnf("message from rabbitmq not suppported and drop it, %s, msg : %.20s", err, content)
+		return 0, true, err
 	}
-	if !jsonParsed.Exists("body") || !jsonParsed.Exists("header") ||
-		!jsonParsed.Exists("ip") || !jsonParsed.Exists("method") || !jsonParsed.Exists("args") {
-		ctx1.Warnf("message from rabbitmq not suppported and drop it, msg : %s", content[:20])
-		return nil
-	}
-	body := jsonParsed.S("body").Data().(string)
-	header, _ := jsonParsed.S("header").ChildrenMap()
-	ip := jsonParsed.S("ip").Data().(string)
-	args := jsonParsed.S("args").Data().(string)
-	method := jsonParsed.S("method").Data().(string)
-	url := c.URL
-	if args != "" {
-		if strings.Contains(c.URL, "?") {
-			url = c.URL + "&" + args
-		} else {
-			url = c.URL + "?" + args
+	//the publisher waiting for reply gets it at once when the delivery is not sent
+	defer func() {
+		if dropped && e.ReplyTo != "" && e.ReplyConsumer == c.ID {
+			if er := sendUndeliveredReply(e, err); er != nil {
+				ctx.With(logger.Fields{"call": "sendUndeliveredReply"}).Warnf("fail,%s", er)
+			}
 		}
+	}()
+	matched, err := filterMatch(c.Filter, e)
+	if err != nil {
+		ctx.With(logger.Fields{"call": "filterMatch"}).Warnf("filter of consumer [%s] invalid and drop it, %s", c.ID, err)
+		return 0, true, err
 	}
-	var headerMap = make(map[string]string)
-	for k, child := range header {
-		headerMap[k] = child.Data().(string)
+	if !matched {
+		return 0, true, errFiltered
 	}
-	client := fasthttp.Client{}
-	client.MaxConnsPerHost = 65535
-	req := &fasthttp.Request{}
-	resp := &fasthttp.Response{}
-	req.SetRequestURI(url)
-	for k, v := range headerMap {
-		req.Header.Set(k, v)
+	ctx2 := ctx.With(logger.Fields{"http": c.URL, "method": e.Method})
+	if e.Method != "post" && e.Method != "get" {
+		err = fmt.Errorf("method [ %s ] not supported", e.Method)
+		ctx2.Warnf("consume fail,%s", err)
+		return
 	}
-	req.Header.Set(cfg.GetString("publish.RealIpHeader"), ip)
-	req.Header.SetUserAgent("wmq v" + cfg.GetString("wmq.version") + " - https://github.com/snail007/wmq")
-
-	ctx2 := ctx.With(logger.Fields{"http": c.URL, "method": method})
-	if method == "post" {
-		if body != "" {
-			var decodeBytes []byte
-			decodeBytes, err = base64.StdEncoding.DecodeString(body)
-			if err != nil {
-				err = nil
-				ctx2.Warnf("decode post body fail and drop it , content : " + content)
-				return
-			}
-			req.SetBody(decodeBytes)
-		}
-		req.Header.SetMethod("POST")
-	} else if method == "get" {
-		req.Header.SetMethod("GET")
-	} else {
-		err = fmt.Errorf("method [ %s ] not supported", method)
+	req, err := newConsumerRequest(e, c)
+	if err != nil {
+		//the same message always fail to transform,so drop it
+		dropped = true
+		ctx2.Warnf("%s and drop it , content : %s", err, content)
+		return
+	}
+	d, _, err := getDeliverer(c.URL)
+	if err != nil {
 		ctx2.Warnf("consume fail,%s", err)
 		return
 	}
 	//log.Warnf("%s", req)
-	err = client.DoTimeout(req, resp, time.Duration(time.Duration(c.Timeout)*time.Millisecond))
+	r, err := d.Deliver(req, c)
 	if err != nil {
 		ctx2.Warnf("consume fail,%s", err)
 		return
 	}
+	code = r.Code
+	if e.ReplyTo != "" && e.ReplyConsumer == c.ID {
+		if er := sendReply(e, r); er != nil {
+			ctx2.With(logger.Fields{"call": "sendReply"}).Warnf("fail,%s", er)
+		}
+	}
 	if c.CheckCode {
-		code := resp.StatusCode()
 		ctx3 := ctx2.With(logger.Fields{"httpCode": strconv.Itoa(code)})
-		if float64(code) != c.Code {
-			err = fmt.Errorf("consume fail,httpCode 200 expected ")
+		if err = checkConsumerCode(c, code); err != nil {
 			ctx3.Warnf("%s", err)
 		} else {
 			ctx3.Debugf("consume success")
@@ -741,3 +1090,11 @@ func process(content string, c consumer) (err error) {
 	}
 	return
 }
+
+//checkConsumerCode return error when CheckCode is true and code is not the expected one
+func checkConsumerCode(c consumer, code int) error {
+	if c.CheckCode && float64(code) != c.Code {
+		return fmt.Errorf("consume fail,httpCode 200 expected ")
+	}
+	return nil
+}
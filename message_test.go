@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jeffail/gabs"
+)
+
+func TestConsumerStopThenUpdate(t *testing.T) {
+	//without RabbitMQ the worker keeps sleeping between retries,it's busy and not reading commands
+	pools = &netPool{
+		config: poolConfig{Factory: func() (interface{}, error) { return nil, errors.New("no RabbitMQ") }},
+		conns:  make(chan interface{}, 1),
+		lock:   &sync.RWMutex{},
+	}
+	defer func() { pools = nil }()
+	m := message{Name: "stop-update", Mode: "topic"}
+	c := consumer{ID: "c1", URL: "http://127.0.0.1/wmq", Timeout: 1000}
+	state := func() string {
+		answer, err := statusConsumerWorker(c, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, _ := gabs.ParseJSON([]byte(answer))
+		return j.Path("State").Data().(string)
+	}
+	updateConsumerWorker(c, m)
+	time.Sleep(time.Millisecond * 100)
+	//restart() and updateMessage stop the consumer and add it again
+	stopConsumerWorker(c, m)
+	if s := state(); s != stateStopped {
+		t.Fatalf("state %s after stopped", s)
+	}
+	c.Paused = true
+	updateConsumerWorker(c, m)
+	//the old worker wakes up after GoFailWait and should exit without removing the new one
+	time.Sleep(time.Millisecond * 1500)
+	if s := state(); s != statePaused {
+		t.Fatalf("state %s, the consumer added again should keep running", s)
+	}
+	stopConsumerWorker(c, m)
+	time.Sleep(time.Millisecond * 100)
+	if s := state(); s != stateStopped {
+		t.Fatalf("state %s after stopped", s)
+	}
+}
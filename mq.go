@@ -1,7 +1,6 @@
 package main
 
 import (
-	"net"
 	"sync"
 
 	logger "github.com/snail007/mini-logger"
@@ -45,7 +44,7 @@ func getQueueName(queueName string) string {
 func getExchangeName(exchangeName string) string {
 	return cfg.GetString("rabbitmq.prefix") + exchangeName
 }
-func queueDeclare(name string, durable bool) (queue amqp.Queue, channel *amqp.Channel, err error) {
+func queueDeclare(name string, durable bool, args amqp.Table) (queue amqp.Queue, channel *amqp.Channel, err error) {
 	name = getQueueName(name)
 	ctx := ctxFunc("queueDeclare").With(logger.Fields{"queue": name})
 
@@ -61,7 +60,7 @@ RETRY:
 	}
 	channel, err = getMqChannel()
 	if err == nil {
-		queue, err = channel.QueueDeclare(name, durable, autoDelete, exclusive, noWait, nil)
+		queue, err = channel.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
 		channelPools.Put(channel)
 		if err == nil {
 			ctx.Debug("declare success")
@@ -138,7 +137,8 @@ RETRY:
 	return
 }
 
-func queueBindToExchange(queuename, exchangeName, routeKey string) (err error) {
+//queueBindToExchange args is the binding arguments,such as x-match of headers exchange
+func queueBindToExchange(queuename, exchangeName, routeKey string, args amqp.Table) (err error) {
 	queuename = getQueueName(queuename)
 	exchangeName = getExchangeName(exchangeName)
 	ctx := ctxFunc("queueBindToExchange").With(logger.Fields{"queue": queuename, "exchange": exchangeName})
@@ -146,7 +146,7 @@ func queueBindToExchange(queuename, exchangeName, routeKey string) (err error) {
 	channel, err = getMqChannel()
 	defer func() { channelPools.Put(channel) }()
 	if err == nil {
-		err = channel.QueueBind(queuename, routeKey, exchangeName, false, nil)
+		err = channel.QueueBind(queuename, routeKey, exchangeName, false, args)
 		if err == nil {
 			ctx.Debugf("success")
 			return
@@ -156,6 +156,43 @@ func queueBindToExchange(queuename, exchangeName, routeKey string) (err error) {
 	return
 }
 
+func queueUnbindFromExchange(queuename, exchangeName, routeKey string, args amqp.Table) (err error) {
+	queuename = getQueueName(queuename)
+	exchangeName = getExchangeName(exchangeName)
+	ctx := ctxFunc("queueUnbindFromExchange").With(logger.Fields{"queue": queuename, "exchange": exchangeName})
+	var channel *amqp.Channel
+	channel, err = getMqChannel()
+	defer func() { channelPools.Put(channel) }()
+	if err == nil {
+		err = channel.QueueUnbind(queuename, routeKey, exchangeName, args)
+		if err == nil {
+			ctx.Debugf("success")
+			return
+		}
+	}
+	ctx.Errorf("fail,%s", err)
+	return
+}
+
+//queueInspect return the queue without declaring it,it never deletes the queue,
+//so it's safe for read only calls such as status.
+func queueInspect(name string) (queue amqp.Queue, err error) {
+	name = getQueueName(name)
+	ctx := ctxFunc("queueInspect").With(logger.Fields{"queue": name})
+	var channel *amqp.Channel
+	channel, err = getMqChannel()
+	if err != nil {
+		ctx.Errorf("fail,%s", err)
+		return
+	}
+	//channel is closed by RabbitMQ when the queue doesn't exist,pool releases it
+	defer channelPools.Put(channel)
+	queue, err = channel.QueueDeclarePassive(name, false, false, false, false, nil)
+	if err != nil {
+		ctx.Warnf("fail,%s", err)
+	}
+	return
+}
 func deleteQueue(queueName string) (err error) {
 	queueName = getQueueName(queueName)
 	ctx := ctxFunc("deleteQueue").With(logger.Fields{"queue": queueName})
@@ -196,8 +233,25 @@ func deleteExchange(exchangeName string) (err error) {
 	return
 }
 
+//newMqConnection dial to RabbitMQ nodes one by one until success,
+//the connection is watched by connMgr
+func newMqConnection() (conn *amqp.Connection, err error) {
+	ctx := ctxFunc("newMqConnection")
+	for _, node := range orderedNodes() {
+		conn, err = amqp.DialConfig(node.uri, mqDialConfig())
+		ctx1 := ctx.With(logger.Fields{"node": node.Addr})
+		if err == nil {
+			node.success()
+			connMgr.watchConnection(conn, node.Addr)
+			ctx1.Debugf("Connect to RabbitMQ SUCCESS")
+			return
+		}
+		node.fail(err)
+		ctx1.Debugf("Connect to RabbitMQ FAIL,ERR:%s", err)
+	}
+	return
+}
 func initPool() (err error) {
-	ctx := ctxFunc("initPool")
 	poolcfg := poolConfig{
 		InitialCap: poolInitialCap,
 		MaxCap:     poolMaxCap,
@@ -208,38 +262,13 @@ func initPool() (err error) {
 			}
 		},
 		Factory: func() (retConn interface{}, err error) {
-			retConn, err = amqp.DialConfig(uri, amqp.Config{
-				Heartbeat: mqHeartbeat,
-				Dial: func(network, addr string) (net.Conn, error) {
-					c, err := net.DialTimeout(network, addr, mqConnectionAndDeadlineTimeout)
-					if err != nil {
-						return nil, err
-					}
-					// if err := c.SetDeadline(time.Now().Add(mqConnectionAndDeadlineTimeout)); err != nil {
-					// 	return nil, err
-					// }
-					return c, nil
-				},
-			})
-			if err == nil {
-				ctx.Debugf("Connect to RabbitMQ SUCCESS")
-				return
-			}
-			ctx.Debugf("Connect to RabbitMQ FAIL,ERR:%s , URI:%s", err, uri)
-			return
+			return newMqConnection()
 		},
 		IsActive: func(conn interface{}) (ok bool) {
 			if conn == nil {
 				return false
 			}
-			ch, err := conn.(*amqp.Connection).Channel()
-			if err != nil {
-				//log.Debugf("conn is not active")
-				return false
-			}
-			ch.Close()
-			//log.Debugf("conn is active")
-			return true
+			return connMgr.isConnectionActive(conn.(*amqp.Connection))
 		},
 	}
 	pools, err = newNetPool(poolcfg)
@@ -261,10 +290,12 @@ func initChannelPool() (err error) {
 			conn, err := pools.Get()
 			defer pools.Put(conn)
 			if err == nil {
-				retConn, err = conn.(*amqp.Connection).Channel()
+				var ch *amqp.Channel
+				ch, err = conn.(*amqp.Connection).Channel()
 				if err == nil {
+					connMgr.watchChannel(ch, conn.(*amqp.Connection))
 					ctx.Debugf("Channel Create  SUCCESS")
-					return
+					return ch, nil
 				}
 			}
 			ctx.Debugf("Channel Create FAIL")
@@ -278,14 +309,7 @@ func initChannelPool() (err error) {
 			if !ok || ch == nil {
 				return false
 			}
-			err := ch.Tx()
-			if err != nil {
-				//log.Infof("channel is not active %s", err)
-				return false
-			}
-			ch.TxCommit()
-			//log.Debugf("channel is active")
-			return true
+			return connMgr.isChannelActive(ch)
 		},
 	}
 	channelPools, err = newNetPool(poolcfg)
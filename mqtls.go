@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	//mqTLSConfig is nil when tls is disabled
+	mqTLSConfig *tls.Config
+	//mqSASL is nil means PLAIN with username and password
+	mqSASL []amqp.Authentication
+)
+
+//externalAuth is the EXTERNAL SASL mechanism,
+//RabbitMQ authenticate the client with its certificate.
+type externalAuth struct{}
+
+func (a *externalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+func (a *externalAuth) Response() string {
+	return ""
+}
+
+//initMqTLS init tls and auth settings of connections to RabbitMQ
+func initMqTLS() (err error) {
+	auth := cfg.GetString("rabbitmq.auth")
+	switch auth {
+	case "", "plain":
+		mqSASL = nil
+	case "external":
+		if !cfg.GetBool("rabbitmq.tls.enable") {
+			return errors.New("auth external requires rabbitmq.tls.enable")
+		}
+		if cfg.GetString("rabbitmq.tls.cert") == "" {
+			return errors.New("auth external requires rabbitmq.tls.cert")
+		}
+		mqSASL = []amqp.Authentication{&externalAuth{}}
+	default:
+		return fmt.Errorf("auth [%s] not supported,should be one of plain,external", auth)
+	}
+	if !cfg.GetBool("rabbitmq.tls.enable") {
+		mqTLSConfig = nil
+		return
+	}
+	mqTLSConfig, err = newTLSClientConfig(cfg.GetString("rabbitmq.tls.ca"),
+		cfg.GetString("rabbitmq.tls.cert"),
+		cfg.GetString("rabbitmq.tls.key"),
+		cfg.GetString("rabbitmq.tls.serverName"),
+		cfg.GetString("rabbitmq.tls.minVersion"))
+	return
+}
+
+//mqScheme return amqps when tls is enabled
+func mqScheme() string {
+	if cfg.GetBool("rabbitmq.tls.enable") {
+		return "amqps"
+	}
+	return "amqp"
+}
+
+//mqDialConfig return the config to dial RabbitMQ
+func mqDialConfig() amqp.Config {
+	c := amqp.Config{
+		Heartbeat: mqHeartbeat,
+		SASL:      mqSASL,
+		Dial: func(network, addr string) (net.Conn, error) {
+			c, err := net.DialTimeout(network, addr, mqConnectionAndDeadlineTimeout)
+			if err != nil {
+				return nil, err
+			}
+			// if err := c.SetDeadline(time.Now().Add(mqConnectionAndDeadlineTimeout)); err != nil {
+			// 	return nil, err
+			// }
+			return c, nil
+		},
+	}
+	if mqTLSConfig != nil {
+		//amqp set ServerName to the dialing node when it's empty,so clone it for every node
+		c.TLSClientConfig = mqTLSConfig.Clone()
+	}
+	return c
+}
+
+//newTLSClientConfig caFile empty means system roots,certFile empty means no client certificate
+func newTLSClientConfig(caFile, certFile, keyFile, serverName, minVersion string) (c *tls.Config, err error) {
+	c = &tls.Config{ServerName: serverName}
+	if c.MinVersion, err = parseTLSVersion(minVersion); err != nil {
+		return
+	}
+	if caFile != "" {
+		c.RootCAs, err = loadCertPool(caFile)
+		if err != nil {
+			return
+		}
+	}
+	if certFile != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			err = fmt.Errorf("load certificate %s fail,%s", certFile, err)
+			return
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+func loadCertPool(caFile string) (pool *x509.CertPool, err error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		err = fmt.Errorf("read ca %s fail,%s", caFile, err)
+		return
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		err = fmt.Errorf("no certificate found in ca %s", caFile)
+	}
+	return
+}
+
+//parseTLSVersion parse version such as 1.2,empty means default of crypto/tls
+func parseTLSVersion(v string) (version uint16, err error) {
+	switch v {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("tls version [%s] not supported,should be one of 1.0,1.1,1.2,1.3", v)
+}
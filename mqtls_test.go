@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+//testCert is a certificate and key signed by ca,ca nil means self signed
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, cn string, ca *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	parent, parentKey := tpl, key
+	if ca != nil {
+		parent, parentKey = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+//write the certificate and key as pem files in dir
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+//brokerHandshake is what the broker stand-in got from the client
+type brokerHandshake struct {
+	clientCN  string
+	mechanism string
+	err       error
+}
+
+//startBroker start a tls listener which speaks AMQP until connection.start-ok,
+//it requires a client certificate signed by clientCA and offers EXTERNAL and PLAIN.
+func startBroker(t *testing.T, server *testCert, clientCA *testCert) (addr string, result <-chan brokerHandshake) {
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCA.cert)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ch := make(chan brokerHandshake, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			ch <- brokerHandshake{err: err}
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		ch <- serveHandshake(conn.(*tls.Conn))
+	}()
+	return l.Addr().String(), ch
+}
+
+func serveHandshake(conn *tls.Conn) (h brokerHandshake) {
+	if h.err = conn.Handshake(); h.err != nil {
+		return
+	}
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		h.clientCN = certs[0].Subject.CommonName
+	}
+	r := bufio.NewReader(conn)
+	header := make([]byte, 8)
+	if _, h.err = io.ReadFull(r, header); h.err != nil {
+		return
+	}
+	//connection.start,version 0-9,empty server properties
+	var payload []byte
+	payload = append(payload, 0, 10, 0, 10, 0, 9, 0, 0, 0, 0)
+	payload = appendLongString(payload, "EXTERNAL PLAIN")
+	payload = appendLongString(payload, "en_US")
+	if _, h.err = conn.Write(amqpFrame(payload)); h.err != nil {
+		return
+	}
+	//connection.start-ok,client properties table then mechanism
+	frame := make([]byte, 7)
+	if _, h.err = io.ReadFull(r, frame); h.err != nil {
+		return
+	}
+	payload = make([]byte, binary.BigEndian.Uint32(frame[3:7])+1)
+	if _, h.err = io.ReadFull(r, payload); h.err != nil {
+		return
+	}
+	tableSize := binary.BigEndian.Uint32(payload[4:8])
+	mechanism := payload[8+tableSize:]
+	h.mechanism = string(mechanism[1 : 1+mechanism[0]])
+	return
+}
+
+func appendLongString(b []byte, s string) []byte {
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(s)))
+	return append(append(b, size...), s...)
+}
+
+func amqpFrame(payload []byte) []byte {
+	frame := []byte{1, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[3:], uint32(len(payload)))
+	return append(append(frame, payload...), 0xCE)
+}
+
+func TestMqTLSExternal(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "wmq-ca", nil, true)
+	otherCA := newTestCert(t, "other-ca", nil, true)
+	server := newTestCert(t, "rabbitmq", ca, false)
+	client := newTestCert(t, "wmq", ca, false)
+	caFile, _ := ca.write(t, dir, "ca")
+	otherCAFile, _ := otherCA.write(t, dir, "other-ca")
+	certFile, keyFile := client.write(t, dir, "client")
+	otherCert := newTestCert(t, "wmq", otherCA, false)
+	otherCertFile, otherKeyFile := otherCert.write(t, dir, "other-client")
+	defer func() {
+		for _, k := range []string{"rabbitmq.auth", "rabbitmq.tls.enable", "rabbitmq.tls.ca",
+			"rabbitmq.tls.cert", "rabbitmq.tls.key", "rabbitmq.tls.minVersion"} {
+			cfg.Set(k, nil)
+		}
+		mqTLSConfig, mqSASL = nil, nil
+	}()
+	tests := []struct {
+		name      string
+		auth      string
+		ca        string
+		cert, key string
+		mechanism string
+		ok        bool
+	}{
+		{"external", "external", caFile, certFile, keyFile, "EXTERNAL", true},
+		{"plain over tls", "plain", caFile, certFile, keyFile, "PLAIN", true},
+		{"untrusted broker", "external", otherCAFile, certFile, keyFile, "", false},
+		{"untrusted client", "external", caFile, otherCertFile, otherKeyFile, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Set("rabbitmq.auth", tt.auth)
+			cfg.Set("rabbitmq.tls.enable", true)
+			cfg.Set("rabbitmq.tls.ca", tt.ca)
+			cfg.Set("rabbitmq.tls.cert", tt.cert)
+			cfg.Set("rabbitmq.tls.key", tt.key)
+			cfg.Set("rabbitmq.tls.minVersion", "1.2")
+			if err := initMqTLS(); err != nil {
+				t.Fatal(err)
+			}
+			addr, result := startBroker(t, server, ca)
+			//the stand-in closes the connection after start-ok,so dialing always fails
+			amqp.DialConfig(mqScheme()+"://guest:guest@"+addr+"/", mqDialConfig())
+			h := <-result
+			if (h.err == nil) != tt.ok {
+				t.Fatalf("handshake err %v, want ok %v", h.err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			if h.clientCN != "wmq" {
+				t.Fatalf("client certificate %q, want wmq", h.clientCN)
+			}
+			if h.mechanism != tt.mechanism {
+				t.Fatalf("mechanism %q, want %q", h.mechanism, tt.mechanism)
+			}
+		})
+	}
+}
+
+func TestInitMqTLS(t *testing.T) {
+	defer func() {
+		for _, k := range []string{"rabbitmq.auth", "rabbitmq.tls.enable", "rabbitmq.tls.cert", "rabbitmq.tls.minVersion"} {
+			cfg.Set(k, nil)
+		}
+		mqTLSConfig, mqSASL = nil, nil
+	}()
+	tests := []struct {
+		name       string
+		auth       string
+		tls        bool
+		cert       string
+		minVersion string
+		ok         bool
+	}{
+		{"plain", "plain", false, "", "", true},
+		{"default auth", "", false, "", "", true},
+		{"unknown auth", "cram-md5", false, "", "", false},
+		{"external without tls", "external", false, "/tmp/client.crt", "", false},
+		{"external without certificate", "external", true, "", "", false},
+		{"tls version", "plain", true, "", "1.3", true},
+		{"bad tls version", "plain", true, "", "1.4", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Set("rabbitmq.auth", tt.auth)
+			cfg.Set("rabbitmq.tls.enable", tt.tls)
+			cfg.Set("rabbitmq.tls.cert", tt.cert)
+			cfg.Set("rabbitmq.tls.minVersion", tt.minVersion)
+			err := initMqTLS()
+			if (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok %v", err, tt.ok)
+			}
+			if err == nil && (mqTLSConfig != nil) != tt.tls {
+				t.Fatalf("tls config %v, want %v", mqTLSConfig != nil, tt.tls)
+			}
+		})
+	}
+}
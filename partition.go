@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/snail007/mini-logger"
+	"github.com/streadway/amqp"
+)
+
+//partition process deliveries of different keys concurrently,
+//deliveries of the same key are processed one by one in order.
+type partition struct {
+	//Key is header.Name,query.name or body.path such as body.order.id,
+	//deliveries without the key are in the same partition
+	Key string
+	//Concurrency partitions processed concurrently
+	Concurrency int
+}
+
+const partitionMaxConcurrency = 1000
+
+var partitionRoots = []string{"header", "query", "body"}
+
+//check return error when partition is malformed
+func (p *partition) check() error {
+	path := strings.Split(p.Key, ".")
+	if ok, _ := inArray(path[0], partitionRoots); !ok || len(path) < 2 {
+		return errors.New("Key should be header.Name,query.name or body.path")
+	}
+	if p.Concurrency < 1 || p.Concurrency > partitionMaxConcurrency {
+		return fmt.Errorf("Concurrency should be between 1 and %d", partitionMaxConcurrency)
+	}
+	return nil
+}
+
+//partitionKey return the value of key in content from RabbitMQ,
+//empty when it's not found or content is not supported
+func partitionKey(key, content string) string {
+	e, err := parseEnvelope(content)
+	if err != nil {
+		return ""
+	}
+	switch v := newFilterData(e).lookup(strings.Split(key, ".")).(type) {
+	case missing, nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+//partitioner is owned by consumer worker,every lane is a goroutine processing
+//deliveries of its partitions in order.
+type partitioner struct {
+	lanes    []chan amqp.Delivery
+	stopChan chan struct{}
+	stopOnce *sync.Once
+	wg       *sync.WaitGroup
+	//current return the latest consumer,it may be updated while processing
+	current func() consumer
+	stats   *consumerStats
+	ctx     logger.MiniLogger
+}
+
+//newPartitioner start n lanes,prefetch is the max unacked deliveries on the channel,
+//so dispatch never blocks.
+func newPartitioner(n, prefetch int, current func() consumer, stats *consumerStats, ctx logger.MiniLogger) *partitioner {
+	p := &partitioner{
+		stopChan: make(chan struct{}),
+		stopOnce: &sync.Once{},
+		wg:       &sync.WaitGroup{},
+		current:  current,
+		stats:    stats,
+		ctx:      ctx,
+	}
+	for i := 0; i < n; i++ {
+		lane := make(chan amqp.Delivery, prefetch)
+		p.lanes = append(p.lanes, lane)
+		p.wg.Add(1)
+		go p.run(lane)
+	}
+	return p
+}
+
+//dispatch send delivery to the lane of key,beginDelivery must be called before it
+func (p *partitioner) dispatch(key string, d amqp.Delivery) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	p.lanes[h.Sum32()%uint32(len(p.lanes))] <- d
+}
+
+//stop wait for the deliveries being processed,the others are requeued by RabbitMQ
+//when the channel is closed
+func (p *partitioner) stop() {
+	p.stopOnce.Do(func() {
+		close(p.stopChan)
+	})
+	p.wg.Wait()
+}
+
+func (p *partitioner) run(lane chan amqp.Delivery) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.stopChan:
+			for {
+				select {
+				case <-lane:
+					endDelivery()
+				default:
+					return
+				}
+			}
+		case d := <-lane:
+			p.deliver(d)
+		}
+	}
+}
+
+//deliver process d until success,later deliveries of the same partition are waiting for it,
+//so it's retried in place instead of requeued.
+func (p *partitioner) deliver(d amqp.Delivery) {
+	defer endDelivery()
+	for {
+		c := p.current()
+		//only HalfOpenProbes lanes deliver while the circuit is half-open
+		if !p.stats.circuitAcquire(c.CircuitBreaker) {
+			select {
+			case <-time.After(circuitProbeWait):
+				continue
+			case <-p.stopChan:
+				return
+			}
+		}
+		//the rate limit is shared by all lanes
+		if !p.stats.throttle(c.RateLimit, p.stopChan, nil) {
+			p.stats.circuitRelease()
+			return
+		}
+		start := time.Now()
+		code, dropped, err := process(string(d.Body), c)
+		if dropped {
+			//nothing is sent,the token is for the next delivery
+			p.stats.returnToken(c.RateLimit)
+		}
+		if err == errFiltered {
+			p.stats.filtered()
+			err = nil
+		} else if dropped {
+			p.stats.dropped(err)
+			err = nil
+		} else if err == nil {
+			p.stats.delivered(1, code, time.Since(start))
+		} else {
+			p.stats.failed(1, code, err, time.Since(start))
+		}
+		p.stats.circuitRelease()
+		if err == nil {
+			if err = d.Ack(false); err != nil {
+				p.ctx.Warnf("ack fail , %s", err)
+			}
+			return
+		}
+		p.stats.setState(stateRetrying)
+		select {
+		case <-time.After(time.Second * time.Duration(cfg.GetInt("consume.FailWait"))):
+			p.stats.setState(stateConsuming)
+		case <-p.stopChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+//testContent return content published to RabbitMQ by apiPublish
+func testContent(t *testing.T, body string, header map[string]string, args string) string {
+	h, _ := json.Marshal(header)
+	b, err := json.Marshal(map[string]interface{}{
+		"body":   base64.StdEncoding.EncodeToString([]byte(body)),
+		"header": string(h),
+		"ip":     "127.0.0.1",
+		"method": "post",
+		"args":   args,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestPartitionKey(t *testing.T) {
+	content := testContent(t, `{"order":{"id":1001,"user":"bob"},"items":[{"sku":"a-1"}]}`,
+		map[string]string{"X-Tenant": "acme"}, "region=eu")
+	tests := []struct {
+		key     string
+		content string
+		want    string
+	}{
+		{"body.order.id", content, "1001"},
+		{"body.order.user", content, "bob"},
+		{"body.items.0.sku", content, "a-1"},
+		{"body.order", content, `map[id:1001 user:bob]`},
+		{"body.order.missing", content, ""},
+		{"header.x-tenant", content, "acme"},
+		{"query.region", content, "eu"},
+		{"query.missing", content, ""},
+		{"body.order.id", testContent(t, "not json", nil, ""), ""},
+		{"body.order.id", "not supported", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := partitionKey(tt.key, tt.content); got != tt.want {
+				t.Fatalf("key %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartitionCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		p    partition
+		ok   bool
+	}{
+		{"body", partition{Key: "body.order.id", Concurrency: 4}, true},
+		{"header", partition{Key: "header.X-Tenant", Concurrency: 1}, true},
+		{"no name", partition{Key: "body", Concurrency: 4}, false},
+		{"unknown root", partition{Key: "ip.addr", Concurrency: 4}, false},
+		{"no concurrency", partition{Key: "body.id"}, false},
+		{"too many", partition{Key: "body.id", Concurrency: partitionMaxConcurrency + 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.p.check(); (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -11,6 +11,7 @@ type ConnPool interface {
 	Put(conn interface{})
 	ReleaseAll()
 	Len() (length int)
+	Prune()
 }
 type poolConfig struct {
 	Factory    func() (interface{}, error)
@@ -24,7 +25,7 @@ func newNetPool(poolConfig poolConfig) (pool ConnPool, err error) {
 	p := netPool{
 		config: poolConfig,
 		conns:  make(chan interface{}, poolConfig.MaxCap),
-		lock:   &sync.Mutex{},
+		lock:   &sync.RWMutex{},
 	}
 	for i := 0; i < poolConfig.InitialCap; i++ {
 		c, err := poolConfig.Factory()
@@ -40,13 +41,15 @@ func newNetPool(poolConfig poolConfig) (pool ConnPool, err error) {
 
 type netPool struct {
 	conns  chan interface{}
-	lock   *sync.Mutex
+	lock   *sync.RWMutex
 	config poolConfig
 }
 
+//Get return an idle active item or a new one made by Factory,
+//IsActive should be cheap,it's called on every Get and Put
 func (p *netPool) Get() (conn interface{}, err error) {
-	p.lock.Lock()
-	defer p.lock.Unlock()
+	p.lock.RLock()
+	defer p.lock.RUnlock()
 	for {
 		select {
 		case conn = <-p.conns:
@@ -69,10 +72,11 @@ func (p *netPool) Put(conn interface{}) {
 	if conn == nil {
 		return
 	}
-	p.lock.Lock()
-	defer p.lock.Unlock()
+	p.lock.RLock()
+	defer p.lock.RUnlock()
 	if !p.config.IsActive(conn) {
 		p.config.Release(conn)
+		return
 	}
 	select {
 	case p.conns <- conn:
@@ -90,6 +94,29 @@ func (p *netPool) ReleaseAll() {
 	p.conns = make(chan interface{}, p.config.InitialCap)
 
 }
+
+//Prune release idle items which are not active any more,
+//it holds the write lock,so items are not taken or returned while they are checked
+func (p *netPool) Prune() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i := len(p.conns); i > 0; i-- {
+		select {
+		case conn := <-p.conns:
+			if p.config.IsActive(conn) {
+				select {
+				case p.conns <- conn:
+				default:
+					p.config.Release(conn)
+				}
+			} else {
+				p.config.Release(conn)
+			}
+		default:
+			return
+		}
+	}
+}
 func (p *netPool) Len() (length int) {
 	return len(p.conns)
 }
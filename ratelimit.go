@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+//rateLimit limit requests to consumer's URL,it's a token bucket shared by
+//all partitions of consumer,a batch is one request.
+type rateLimit struct {
+	//Rate requests per second,such as 0.5 means one request every 2 seconds
+	Rate float64
+	//Burst requests can be sent at once after idle,0 means 1
+	Burst int
+}
+
+//check return error when rate limit is malformed
+func (rl *rateLimit) check() error {
+	if rl.Rate <= 0 {
+		return errors.New("Rate should be greater than 0")
+	}
+	if rl.Burst < 0 {
+		return errors.New("Burst should not be less than 0")
+	}
+	return nil
+}
+
+func (rl *rateLimit) burst() float64 {
+	if rl.Burst < 1 {
+		return 1
+	}
+	return float64(rl.Burst)
+}
+
+//throttle block until a request to consumer's URL is allowed by rl,
+//false means it's stopped by stop,a command on wake or shutting down,
+//and the delivery should be requeued.wake is the worker's command channel,
+//the worker checks it's consumer again after the delivery is requeued.
+func (s *consumerStats) throttle(rl *rateLimit, stop <-chan struct{}, wake <-chan string) bool {
+	for waited := false; ; waited = true {
+		wait := s.takeToken(rl, waited)
+		if wait == 0 {
+			return true
+		}
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return false
+		case <-wake:
+			return false
+		case <-shutdownChan:
+			return false
+		}
+	}
+}
+
+//returnToken give back the token taken for a delivery which is not sent to consumer's URL,
+//such as filtered or dropped ones
+func (s *consumerStats) returnToken(rl *rateLimit) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if rl == nil || s.tokensTime.IsZero() {
+		return
+	}
+	s.tokens = math.Min(s.tokens+1, rl.burst())
+}
+
+//setRateLimit is called when the worker of consumer is started or updated,
+//so the status shows the rate limit before any request
+func (s *consumerStats) setRateLimit(rl *rateLimit) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.RateLimit = rl
+}
+
+//takeToken return how long to wait for a token,0 means the token is taken
+func (s *consumerStats) takeToken(rl *rateLimit, waited bool) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if rl == nil {
+		return 0
+	}
+	now := time.Now()
+	if s.tokensTime.IsZero() {
+		s.tokens = rl.burst()
+	} else {
+		s.tokens += now.Sub(s.tokensTime).Seconds() * rl.Rate
+	}
+	if s.tokens > rl.burst() {
+		s.tokens = rl.burst()
+	}
+	s.tokensTime = now
+	if s.tokens >= 1 {
+		s.tokens--
+		return 0
+	}
+	if !waited {
+		s.Throttled++
+	}
+	return time.Duration((1 - s.tokens) / rl.Rate * float64(time.Second))
+}
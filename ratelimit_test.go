@@ -0,0 +1,164 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestTakeToken(t *testing.T) {
+	tests := []struct {
+		name string
+		rl   *rateLimit
+		//idle seconds before the last take
+		idle float64
+		//takes before the last one
+		takes int
+		//wait of the last take,0 means taken
+		wait time.Duration
+	}{
+		{"no limit", nil, 0, 100, 0},
+		{"first", &rateLimit{Rate: 10}, 0, 0, 0},
+		{"burst 0 means 1", &rateLimit{Rate: 10}, 0, 1, 100 * time.Millisecond},
+		{"in burst", &rateLimit{Rate: 10, Burst: 5}, 0, 4, 0},
+		{"over burst", &rateLimit{Rate: 10, Burst: 5}, 0, 5, 100 * time.Millisecond},
+		{"slow rate", &rateLimit{Rate: 0.5}, 0, 1, 2 * time.Second},
+		{"refilled", &rateLimit{Rate: 10, Burst: 5}, 0.1, 5, 0},
+		{"refill is capped by burst", &rateLimit{Rate: 10, Burst: 2}, 60, 2, 0},
+		{"half refilled", &rateLimit{Rate: 10, Burst: 1}, 0.05, 1, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newConsumerStats()
+			for i := 0; i < tt.takes; i++ {
+				s.takeToken(tt.rl, false)
+			}
+			if tt.idle > 0 {
+				s.tokensTime = s.tokensTime.Add(-time.Duration(tt.idle * float64(time.Second)))
+			}
+			wait := s.takeToken(tt.rl, false)
+			//time elapsed while testing makes the wait a little shorter
+			if wait > tt.wait || wait < tt.wait-10*time.Millisecond {
+				t.Fatalf("wait %s, want %s", wait, tt.wait)
+			}
+		})
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	rl := &rateLimit{Rate: 1}
+	s := newConsumerStats()
+	s.takeToken(rl, false)
+	//a request waiting for the token is counted once
+	s.takeToken(rl, false)
+	s.takeToken(rl, true)
+	s.takeToken(rl, true)
+	if s.Throttled != 1 {
+		t.Fatalf("throttled %d, want 1", s.Throttled)
+	}
+	stop := make(chan struct{})
+	close(stop)
+	if s.throttle(rl, stop, nil) {
+		t.Fatal("throttle should return false when it's stopped")
+	}
+	//worker is told to pause,update or exit
+	wake := make(chan string, 1)
+	wake <- "pause"
+	if s.throttle(rl, nil, wake) {
+		t.Fatal("throttle should return false when worker gets a command")
+	}
+	if !s.throttle(nil, stop, wake) {
+		t.Fatal("throttle without rate limit should not block")
+	}
+}
+
+func TestReturnToken(t *testing.T) {
+	rl := &rateLimit{Rate: 0.01, Burst: 2}
+	tests := []struct {
+		name string
+		//takes before returning one
+		takes int
+		//returns before the last take
+		returns int
+		wait    bool
+	}{
+		{"not taken", 0, 1, false},
+		{"returned", 2, 1, false},
+		{"not returned", 2, 0, true},
+		{"capped by burst", 1, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newConsumerStats()
+			for i := 0; i < tt.takes; i++ {
+				s.takeToken(rl, false)
+			}
+			for i := 0; i < tt.returns; i++ {
+				s.returnToken(rl)
+			}
+			if s.tokens > rl.burst() {
+				t.Fatalf("tokens %f over burst", s.tokens)
+			}
+			if wait := s.takeToken(rl, false); (wait > 0) != tt.wait {
+				t.Fatalf("wait %s, want wait %v", wait, tt.wait)
+			}
+		})
+	}
+}
+
+func TestFilteredNotThrottled(t *testing.T) {
+	c := consumer{ID: "c1", URL: "http://127.0.0.1:1/wmq", Timeout: 1000,
+		Filter: `body.amount > 100`, RateLimit: &rateLimit{Rate: 0.01}}
+	stats := newConsumerStats()
+	p := newPartitioner(1, 1, func() consumer { return c }, stats, ctxFunc("test"))
+	defer p.stop()
+	done := make(chan bool)
+	go func() {
+		//filtered deliveries don't use the only token,they are not waiting 100 seconds
+		for i := 0; i < 3; i++ {
+			beginDelivery()
+			p.deliver(amqp.Delivery{Body: []byte(testContent(t, `{"amount":1}`, nil, ""))})
+		}
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("filtered deliveries are throttled")
+	}
+	if stats.Filtered != 3 || stats.Throttled != 0 {
+		t.Fatalf("filtered %d throttled %d", stats.Filtered, stats.Throttled)
+	}
+}
+
+func TestSetRateLimit(t *testing.T) {
+	s := newConsumerStats()
+	rl := &rateLimit{Rate: 5, Burst: 10}
+	s.setRateLimit(rl)
+	if s.RateLimit != rl {
+		t.Fatal("rate limit should be shown before any request")
+	}
+	s.setRateLimit(nil)
+	if s.RateLimit != nil {
+		t.Fatal("rate limit should be removed")
+	}
+}
+
+func TestRateLimitCheck(t *testing.T) {
+	tests := []struct {
+		rl rateLimit
+		ok bool
+	}{
+		{rateLimit{Rate: 0.5}, true},
+		{rateLimit{Rate: 10, Burst: 20}, true},
+		{rateLimit{Rate: 0}, false},
+		{rateLimit{Rate: -1}, false},
+		{rateLimit{Rate: 1, Burst: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.rl.check(); (err == nil) != tt.ok {
+			t.Fatalf("%+v err %v, want ok %v", tt.rl, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	logger "github.com/snail007/mini-logger"
+)
+
+var (
+	dataFileWatchDelay = time.Millisecond * 500
+)
+
+//reloadFromDisk load data file and apply the difference to running consumers
+func reloadFromDisk() (err error) {
+	ctx := ctxFunc("reloadFromDisk").With(logger.Fields{"file": messageDataFilePath})
+	content, err := fileGetContents(messageDataFilePath)
+	if err != nil {
+		ctx.Warnf("read fail, ignored, %s", err)
+		return
+	}
+	newMessages, err := parseMessages(content)
+	if err != nil {
+		ctx.Warnf("invalid data file, ignored, %s", err)
+		return
+	}
+	msgLock.Lock()
+	defer msgLock.Unlock()
+	if content == dataFileContent {
+		ctx.Debugf("written by wmq, ignored")
+		return
+	}
+	err = applyMessages(newMessages)
+	if err != nil {
+		ctx.Warnf("apply fail, %s", err)
+		return
+	}
+	dataFileContent = content
+	ctx.Infof("reloaded")
+	return
+}
+
+func findMessage(messages0 []message, name string) (msg *message) {
+	for k := range messages0 {
+		if messages0[k].Name == name {
+			return &messages0[k]
+		}
+	}
+	return nil
+}
+func findConsumer(consumers []consumer, ID string) (c *consumer) {
+	for k := range consumers {
+		if consumers[k].ID == ID {
+			return &consumers[k]
+		}
+	}
+	return nil
+}
+
+//exchangeChanged return true when the exchange of message should be declared again
+func exchangeChanged(om, nm message) bool {
+	return om.Mode != nm.Mode || om.Durable != nm.Durable
+}
+
+//queueChanged return true when the queues of message should be declared again
+func queueChanged(om, nm message) bool {
+	return exchangeChanged(om, nm) || om.MaxPriority != nm.MaxPriority
+}
+
+//messageChanged return true when workers of message should be updated,
+//workers keep a copy of message to declare exchange and queue when reconnecting.
+func messageChanged(om, nm message) bool {
+	om.Consumers, nm.Consumers = nil, nil
+	return !reflect.DeepEqual(om, nm)
+}
+
+//applyMessages diff newMessages against messages and apply it in two steps,
+//only the affected exchanges,queues and consumer workers will be touched.
+//1.declare and bind what was added or changed,running workers are not touched,
+//  when it fails,what was created is removed and messages is kept.
+//2.update workers,then unbind and remove what was removed,
+//  errors are returned after the rest was applied,messages is newMessages after it.
+//caller must hold msgLock.
+func applyMessages(newMessages []message) (err error) {
+	ctx := ctxFunc("applyMessages")
+	var rollbacks []func()
+	rollback := func() {
+		for i := len(rollbacks) - 1; i >= 0; i-- {
+			rollbacks[i]()
+		}
+	}
+	//1.declare added or changed exchanges,queues and bindings
+	for _, nm := range newMessages {
+		name := nm.Name
+		om := findMessage(messages, nm.Name)
+		if om == nil || exchangeChanged(*om, nm) {
+			_, err = exchangeDeclare(nm.Name, nm.Mode, nm.Durable)
+			if err != nil {
+				rollback()
+				return
+			}
+			if om == nil {
+				rollbacks = append(rollbacks, func() { deleteExchange(name) })
+			}
+		}
+		for _, nc := range nm.Consumers {
+			var oc *consumer
+			if om != nil {
+				oc = findConsumer(om.Consumers, nc.ID)
+			}
+			if om != nil && oc != nil && !queueChanged(*om, nm) && !bindingChanged(*oc, nc) {
+				continue
+			}
+			queue := getConsumerKey(nm, nc)
+			_, _, err = queueDeclare(queue, nm.Durable, nm.queueArgs())
+			if err != nil {
+				rollback()
+				return
+			}
+			if oc == nil {
+				rollbacks = append(rollbacks, func() { deleteQueue(queue) })
+			}
+			//the old binding is removed in step 2
+			err = queueBindToExchange(queue, nm.Name, nc.RouteKey, nc.bindArgs())
+			if err != nil {
+				rollback()
+				return
+			}
+			if oc != nil {
+				routeKey, args := nc.RouteKey, nc.bindArgs()
+				rollbacks = append(rollbacks, func() { queueUnbindFromExchange(queue, name, routeKey, args) })
+			}
+		}
+	}
+	//bind all after exchanges were declared,bindings to a declared again exchange were lost
+	addedBindings, removedBindings := diffBindings(messages, newMessages)
+	for _, b := range addedBindings {
+		b := b
+		rollbacks = append(rollbacks, func() { exchangeUnbind(b.From, b.To, b.RouteKey) })
+	}
+	err = bindMessages(newMessages)
+	if err != nil {
+		rollback()
+		return
+	}
+	//2.switch workers and remove what was removed
+	var errs []string
+	fail := func(e error) {
+		if e != nil {
+			errs = append(errs, e.Error())
+		}
+	}
+	for _, nm := range newMessages {
+		om := findMessage(messages, nm.Name)
+		for _, nc := range nm.Consumers {
+			var oc *consumer
+			if om != nil {
+				oc = findConsumer(om.Consumers, nc.ID)
+			}
+			if om != nil && oc != nil && !messageChanged(*om, nm) && reflect.DeepEqual(*oc, nc) {
+				continue
+			}
+			ctx1 := ctx.With(logger.Fields{"consumer": getConsumerKey(nm, nc)})
+			if _, e := updateConsumerWorker(nc, nm); e != nil {
+				fail(e)
+				continue
+			}
+			if oc == nil {
+				ctx1.Infof("added")
+			} else {
+				oc.forgetCompiled()
+				ctx1.Infof("updated")
+			}
+		}
+	}
+	for _, b := range removedBindings {
+		if e := exchangeUnbind(b.From, b.To, b.RouteKey); e != nil {
+			fail(e)
+			continue
+		}
+		ctx.With(logger.Fields{"message": b.From, "to": b.To}).Infof("unbound")
+	}
+	for _, om := range messages {
+		nm := findMessage(newMessages, om.Name)
+		for _, oc := range om.Consumers {
+			ctx1 := ctx.With(logger.Fields{"consumer": getConsumerKey(om, oc)})
+			if nm != nil {
+				if nc := findConsumer(nm.Consumers, oc.ID); nc != nil {
+					//a queue declared again has no old binding
+					if !queueChanged(om, *nm) && bindingChanged(oc, *nc) {
+						fail(queueUnbindFromExchange(getConsumerKey(om, oc), om.Name, oc.RouteKey, oc.bindArgs()))
+					}
+					continue
+				}
+			}
+			oc.forgetCompiled()
+			if _, e := stopConsumerWorker(oc, om); e != nil {
+				fail(e)
+				continue
+			}
+			fail(deleteQueue(getConsumerKey(om, oc)))
+			ctx1.Infof("removed")
+		}
+		if nm == nil {
+			fail(deleteExchange(om.Name))
+			ctx.With(logger.Fields{"message": om.Name}).Infof("removed")
+		}
+	}
+	messages = newMessages
+	if len(errs) > 0 {
+		err = errors.New(strings.Join(errs, "; "))
+	}
+	return
+}
+
+//watchDataFile reload data file when it was changed
+func watchDataFile(file string) (err error) {
+	ctx := ctxFunc("watchDataFile").With(logger.Fields{"file": file})
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return
+	}
+	//watch the directory,editors usually replace the file by rename
+	err = watcher.Add(filepath.Dir(path))
+	if err != nil {
+		watcher.Close()
+		return
+	}
+	go func() {
+		defer watcher.Close()
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != path ||
+					event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				ctx.Debugf("%s", event)
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(dataFileWatchDelay, func() {
+					reloadFromDisk()
+				})
+			case e, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				ctx.Warnf("watch fail, %s", e)
+			}
+		}
+	}()
+	ctx.Infof("watching")
+	return
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestMessageChanges(t *testing.T) {
+	c := consumer{ID: "c1", URL: "http://127.0.0.1/wmq", RouteKey: "#", Timeout: 5000}
+	old := message{Name: "a", Mode: "topic", Durable: true, Consumers: []consumer{c}}
+	tests := []struct {
+		name                      string
+		change                    func(m *message)
+		exchange, queue, consumer bool
+	}{
+		{"unchanged", func(m *message) {}, false, false, false},
+		{"consumers only", func(m *message) { m.Consumers = nil }, false, false, false},
+		{"mode", func(m *message) { m.Mode = "direct" }, true, true, true},
+		{"durable", func(m *message) { m.Durable = false }, true, true, true},
+		{"max priority", func(m *message) { m.MaxPriority = 10 }, false, true, true},
+		{"bindings", func(m *message) { m.Bindings = []messageBinding{{To: "b", RouteKey: "#"}} }, false, false, true},
+		{"reply consumer", func(m *message) { m.ReplyConsumer = "c1" }, false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := old
+			m.Consumers = append([]consumer{}, old.Consumers...)
+			tt.change(&m)
+			if got := exchangeChanged(old, m); got != tt.exchange {
+				t.Fatalf("exchangeChanged %v, want %v", got, tt.exchange)
+			}
+			if got := queueChanged(old, m); got != tt.queue {
+				t.Fatalf("queueChanged %v, want %v", got, tt.queue)
+			}
+			if got := messageChanged(old, m); got != tt.consumer {
+				t.Fatalf("messageChanged %v, want %v", got, tt.consumer)
+			}
+		})
+	}
+}
+
+//mqStandIn is a broker stand-in which accepts the declarations,bindings and deletions
+//of mq.go and records them,operations refused by fail get a channel exception.
+type mqStandIn struct {
+	lock *sync.Mutex
+	ops  []string
+	fail func(op string) bool
+}
+
+//startMqStandIn start the stand-in and let channelPools take channels from it
+func startMqStandIn(t *testing.T, fail func(op string) bool) *mqStandIn {
+	b := &mqStandIn{lock: &sync.Mutex{}, fail: fail}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	conn, err := amqp.Dial("amqp://guest:guest@" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	channelPools = &netPool{
+		config: poolConfig{
+			Factory: func() (interface{}, error) { return conn.Channel() },
+			//channels closed by exceptions are not reused
+			IsActive: func(interface{}) bool { return false },
+			Release:  func(ch interface{}) { ch.(*amqp.Channel).Close() },
+		},
+		conns: make(chan interface{}, 1),
+		lock:  &sync.RWMutex{},
+	}
+	t.Cleanup(func() {
+		channelPools = nil
+		conn.Close()
+		l.Close()
+	})
+	return b
+}
+
+//takeOps return operations recorded since last call
+func (b *mqStandIn) takeOps() (ops []string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	ops, b.ops = b.ops, nil
+	return
+}
+
+func (b *mqStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if _, err := io.ReadFull(r, make([]byte, 8)); err != nil {
+		return
+	}
+	//connection.start,version 0-9,empty server properties
+	args := []byte{0, 9, 0, 0, 0, 0}
+	args = appendLongString(appendLongString(args, "PLAIN"), "en_US")
+	conn.Write(amqpMethod(0, 10, 10, args))
+	for {
+		channel, class, method, args, err := readAmqpMethod(r)
+		if err != nil {
+			return
+		}
+		var reply []byte
+		switch uint32(class)<<16 | uint32(method) {
+		case 10<<16 | 11: //connection.start-ok,tune with no channel limit and no heartbeat
+			reply = amqpMethod(0, 10, 30, []byte{0, 0, 0, 2, 0, 0, 0, 0})
+		case 10<<16 | 40: //connection.open
+			reply = amqpMethod(0, 10, 41, []byte{0})
+		case 10<<16 | 50: //connection.close
+			conn.Write(amqpMethod(0, 10, 51, nil))
+			return
+		case 20<<16 | 10: //channel.open
+			reply = amqpMethod(channel, 20, 11, []byte{0, 0, 0, 0})
+		case 20<<16 | 40: //channel.close
+			reply = amqpMethod(channel, 20, 41, nil)
+		default:
+			reply = b.handle(channel, class, method, args)
+		}
+		if reply != nil {
+			conn.Write(reply)
+		}
+	}
+}
+
+//handle record the operation and reply it
+func (b *mqStandIn) handle(channel, class, method uint16, args []byte) []byte {
+	//every operation starts with a reserved short and names,close-ok has none
+	if len(args) < 2 {
+		return nil
+	}
+	names := shortStrings(args[2:], 3)
+	ops := map[uint32]struct {
+		name  string
+		names []string
+		reply []byte
+	}{
+		40<<16 | 10: {"exchange.declare", names[:1], amqpMethod(channel, 40, 11, nil)},
+		40<<16 | 20: {"exchange.delete", names[:1], amqpMethod(channel, 40, 21, nil)},
+		40<<16 | 30: {"exchange.bind", []string{names[1], names[0], names[2]}, amqpMethod(channel, 40, 31, nil)},
+		40<<16 | 40: {"exchange.unbind", []string{names[1], names[0], names[2]}, amqpMethod(channel, 40, 51, nil)},
+		50<<16 | 10: {"queue.declare", names[:1], amqpMethod(channel, 50, 11, append([]byte{byte(len(names[0]))}, append([]byte(names[0]), 0, 0, 0, 0, 0, 0, 0, 0)...))},
+		50<<16 | 20: {"queue.bind", names, amqpMethod(channel, 50, 21, nil)},
+		50<<16 | 50: {"queue.unbind", names, amqpMethod(channel, 50, 51, nil)},
+		50<<16 | 40: {"queue.delete", names[:1], amqpMethod(channel, 50, 41, []byte{0, 0, 0, 0})},
+	}
+	op, ok := ops[uint32(class)<<16|uint32(method)]
+	if !ok {
+		return nil
+	}
+	record := strings.Join(append([]string{op.name}, op.names...), " ")
+	b.lock.Lock()
+	b.ops = append(b.ops, record)
+	b.lock.Unlock()
+	if b.fail != nil && b.fail(record) {
+		//channel.close,406 PRECONDITION_FAILED
+		args := []byte{1, 150}
+		args = append(args, byte(len("PRECONDITION_FAILED")))
+		args = append(args, "PRECONDITION_FAILED"...)
+		args = append(args, byte(class>>8), byte(class), byte(method>>8), byte(method))
+		return amqpMethod(channel, 20, 40, args)
+	}
+	return op.reply
+}
+
+func amqpMethod(channel, class, method uint16, args []byte) []byte {
+	payload := []byte{byte(class >> 8), byte(class), byte(method >> 8), byte(method)}
+	frame := amqpFrame(append(payload, args...))
+	binary.BigEndian.PutUint16(frame[1:3], channel)
+	return frame
+}
+
+//readAmqpMethod read frames until a method frame,heartbeats are skipped
+func readAmqpMethod(r *bufio.Reader) (channel, class, method uint16, args []byte, err error) {
+	for {
+		header := make([]byte, 7)
+		if _, err = io.ReadFull(r, header); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[3:7])+1)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			return
+		}
+		if header[0] != 1 {
+			continue
+		}
+		channel = binary.BigEndian.Uint16(header[1:3])
+		class, method = binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint16(payload[2:4])
+		return channel, class, method, payload[4 : len(payload)-1], nil
+	}
+}
+
+//shortStrings read at most n short strings,missing ones are empty
+func shortStrings(b []byte, n int) (s []string) {
+	for i := 0; i < n; i++ {
+		if len(b) == 0 || len(b) < 1+int(b[0]) {
+			s = append(s, "")
+			continue
+		}
+		s = append(s, string(b[1:1+b[0]]))
+		b = b[1+b[0]:]
+	}
+	return
+}
+
+func TestApplyMessages(t *testing.T) {
+	//without connections the workers keep retrying,it's enough to tell they are running
+	pools = &netPool{
+		config: poolConfig{Factory: func() (interface{}, error) { return nil, errors.New("no RabbitMQ") }},
+		conns:  make(chan interface{}, 1),
+		lock:   &sync.RWMutex{},
+	}
+	defer func() { pools = nil }()
+	broker := startMqStandIn(t, func(op string) bool { return op == "queue.bind b-c2 b #" })
+	old := messages
+	defer func() { messages = old }()
+	messages = nil
+	c1 := consumer{ID: "c1", URL: "http://127.0.0.1/wmq", RouteKey: "#", Timeout: 1000}
+	c2 := consumer{ID: "c2", URL: "http://127.0.0.1/wmq", RouteKey: "#", Timeout: 1000}
+	a := message{Name: "a", Mode: "topic", Durable: true, Consumers: []consumer{c1}}
+	aRouted := a
+	aRouted.Consumers = []consumer{c1}
+	aRouted.Consumers[0].RouteKey = "order.*"
+	aEmpty := a
+	aEmpty.Consumers = nil
+	b := message{Name: "b", Mode: "topic", Durable: true, Consumers: []consumer{c2}}
+	running := func(m message, c consumer) bool {
+		answer, _ := statusConsumerWorker(c, m)
+		return !strings.Contains(answer, `"State":"`+stateStopped+`"`)
+	}
+	steps := []struct {
+		name     string
+		messages []message
+		ok       bool
+		ops      []string
+		//messages after applied
+		applied []message
+		running map[string]bool
+	}{
+		{"add", []message{a}, true,
+			[]string{"exchange.declare a", "queue.declare a-c1", "queue.bind a-c1 a #"},
+			[]message{a}, map[string]bool{"c1": true}},
+		{"unchanged", []message{a}, true, nil, []message{a}, map[string]bool{"c1": true}},
+		{"route key", []message{aRouted}, true,
+			[]string{"queue.declare a-c1", "queue.bind a-c1 a order.*", "queue.unbind a-c1 a #"},
+			[]message{aRouted}, map[string]bool{"c1": true}},
+		{"rollback", []message{aRouted, b}, false,
+			[]string{"exchange.declare b", "queue.declare b-c2", "queue.bind b-c2 b #", "queue.delete b-c2", "exchange.delete b"},
+			[]message{aRouted}, map[string]bool{"c1": true, "c2": false}},
+		{"remove consumer", []message{aEmpty}, true,
+			[]string{"queue.delete a-c1"},
+			[]message{aEmpty}, map[string]bool{"c1": false}},
+		{"remove message", []message{}, true,
+			[]string{"exchange.delete a"},
+			[]message{}, nil},
+	}
+	for _, step := range steps {
+		err := applyMessages(step.messages)
+		if (err == nil) != step.ok {
+			t.Fatalf("%s: err %v, want ok %v", step.name, err, step.ok)
+		}
+		if ops := broker.takeOps(); !reflect.DeepEqual(ops, step.ops) {
+			t.Fatalf("%s: ops %q, want %q", step.name, ops, step.ops)
+		}
+		if !reflect.DeepEqual(messages, step.applied) {
+			t.Fatalf("%s: messages %+v, want %+v", step.name, messages, step.applied)
+		}
+		for id, want := range step.running {
+			m, c := a, c1
+			if id == "c2" {
+				m, c = b, c2
+			}
+			if got := running(m, c); got != want {
+				t.Fatalf("%s: consumer %s running %v, want %v", step.name, id, got, want)
+			}
+		}
+	}
+}
+
+func TestReloadFromDisk(t *testing.T) {
+	broker := startMqStandIn(t, nil)
+	old, oldPath, oldContent := messages, messageDataFilePath, dataFileContent
+	defer func() { messages, messageDataFilePath, dataFileContent = old, oldPath, oldContent }()
+	messageDataFilePath = filepath.Join(t.TempDir(), "message.json")
+	write := func(content string) {
+		if err := ioutil.WriteFile(messageDataFilePath, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`[{"Name":"a","Mode":"topic","Durable":true}]`)
+	if _, err := loadMessagesFromFile(messageDataFilePath); err != nil {
+		t.Fatal(err)
+	}
+	//the first event of watcher should not apply the file loaded at startup again
+	if dataFileContent != `[{"Name":"a","Mode":"topic","Durable":true}]` {
+		t.Fatalf("content loaded at startup is not kept,%q", dataFileContent)
+	}
+	steps := []struct {
+		name  string
+		do    func()
+		ok    bool
+		ops   []string
+		names []string
+	}{
+		{"loaded at startup", func() {}, true, nil, []string{"a"}},
+		{"invalid json", func() { write(`[{"Name":`) }, false, nil, []string{"a"}},
+		{"invalid message", func() { write(`[{"Name":"a","Mode":"unknown"}]`) }, false, nil, []string{"a"}},
+		{"changed", func() { write(`[{"Name":"a","Mode":"topic","Durable":true},{"Name":"b","Mode":"fanout"}]`) }, true,
+			[]string{"exchange.declare b"}, []string{"a", "b"}},
+		{"changed already applied", func() {}, true, nil, []string{"a", "b"}},
+		{"written by wmq", func() {
+			if err := writeMessagesToFile(messages[:1], messageDataFilePath); err != nil {
+				t.Fatal(err)
+			}
+		}, true, nil, []string{"a", "b"}},
+	}
+	for _, step := range steps {
+		step.do()
+		if err := reloadFromDisk(); (err == nil) != step.ok {
+			t.Fatalf("%s: err %v, want ok %v", step.name, err, step.ok)
+		}
+		if ops := broker.takeOps(); !reflect.DeepEqual(ops, step.ops) {
+			t.Fatalf("%s: ops %q, want %q", step.name, ops, step.ops)
+		}
+		var names []string
+		for _, m := range messages {
+			names = append(names, m.Name)
+		}
+		if !reflect.DeepEqual(names, step.names) {
+			t.Fatalf("%s: messages %q, want %q", step.name, names, step.names)
+		}
+	}
+}
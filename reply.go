@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	logger "github.com/snail007/mini-logger"
+	"github.com/streadway/amqp"
+	"github.com/valyala/fasthttp"
+)
+
+//replyMessage is the response of consumer's url sent back to the publisher waiting for it
+type replyMessage struct {
+	Code   int
+	Header map[string]string
+	//Body is base64 encoded
+	Body string
+}
+
+var (
+	//replyQueue is the exclusive queue of this wmq instance to receive replies,
+	//empty means it's not ready
+	replyQueue   string
+	replyWaiters = map[string]chan replyMessage{}
+	replyLock    = &sync.Mutex{}
+	//replyIgnoreHeaders are not copied from consumer's response to publisher
+	replyIgnoreHeaders = []string{"Content-Length", "Connection", "Transfer-Encoding", "Date", "Server"}
+)
+
+//getReplyQueue return the reply queue name,error when it's not ready
+func getReplyQueue() (name string, err error) {
+	replyLock.Lock()
+	defer replyLock.Unlock()
+	if replyQueue == "" {
+		err = errors.New("reply queue not ready")
+	}
+	return replyQueue, err
+}
+
+func setReplyQueue(name string) {
+	replyLock.Lock()
+	defer replyLock.Unlock()
+	replyQueue = name
+}
+
+//waitReply register correlationID,the returned chan receive the reply
+func waitReply(correlationID string) <-chan replyMessage {
+	ch := make(chan replyMessage, 1)
+	replyLock.Lock()
+	defer replyLock.Unlock()
+	replyWaiters[correlationID] = ch
+	return ch
+}
+
+//cancelReply must be called when the waiter finished or timeout
+func cancelReply(correlationID string) {
+	replyLock.Lock()
+	defer replyLock.Unlock()
+	delete(replyWaiters, correlationID)
+}
+
+func dispatchReply(d amqp.Delivery) {
+	var r replyMessage
+	if err := json.Unmarshal(d.Body, &r); err != nil {
+		ctxFunc("dispatchReply").Warnf("reply not supported, %s", err)
+		return
+	}
+	replyLock.Lock()
+	defer replyLock.Unlock()
+	//only the first reply of correlation ID is returned,the waiter is removed with it,
+	//so replies of retried deliveries and replies after timeout are dropped
+	ch, ok := replyWaiters[d.CorrelationId]
+	if !ok {
+		ctxFunc("dispatchReply").With(logger.Fields{"correlationId": d.CorrelationId}).Debugf("late or duplicated reply dropped")
+		return
+	}
+	delete(replyWaiters, d.CorrelationId)
+	ch <- r
+}
+
+//consumeReplies declare the reply queue and dispatch replies to waiters,
+//it reconnects until wmq is shutting down.
+func consumeReplies() {
+	ctx := ctxFunc("consumeReplies")
+	for !isShuttingDown() {
+		conn, err := pools.Get()
+		if err != nil {
+			ctx.With(logger.Fields{"call": "pools.Get"}).Warnf("fail,%s", err)
+			sleepOrShutdown(time.Second * time.Duration(cfg.GetInt("consume.GoFailWait")))
+			continue
+		}
+		channel, err := conn.(*amqp.Connection).Channel()
+		pools.Put(conn)
+		if err != nil {
+			ctx.With(logger.Fields{"call": "Channel"}).Warnf("fail,%s", err)
+			sleepOrShutdown(time.Second * time.Duration(cfg.GetInt("consume.GoFailWait")))
+			continue
+		}
+		//server named,exclusive and auto delete,it's removed when wmq exit
+		q, err := channel.QueueDeclare("", false, true, true, false, nil)
+		var deliveries <-chan amqp.Delivery
+		if err == nil {
+			deliveries, err = channel.Consume(q.Name, "", true, true, false, false, nil)
+		}
+		if err != nil {
+			channel.Close()
+			ctx.With(logger.Fields{"call": "QueueDeclare"}).Warnf("fail,%s", err)
+			sleepOrShutdown(time.Second * time.Duration(cfg.GetInt("consume.GoFailWait")))
+			continue
+		}
+		setReplyQueue(q.Name)
+		ctx.With(logger.Fields{"queue": q.Name}).Infof("ready")
+		for d := range deliveries {
+			dispatchReply(d)
+		}
+		setReplyQueue("")
+		channel.Close()
+		ctx.Warnf("reply queue closed, reconnecting")
+		sleepOrShutdown(time.Second * time.Duration(cfg.GetInt("consume.GoFailWait")))
+	}
+}
+
+//sendUndeliveredReply reply the delivery which is filtered or dropped by ReplyConsumer,
+//httpcode is 204 for filtered and 422 for dropped,header Wmq-Reply is the reason.
+func sendUndeliveredReply(e envelope, reason error) error {
+	if reason == errFiltered {
+		return sendReply(e, &DeliveryResult{
+			Code:   fasthttp.StatusNoContent,
+			Header: map[string]string{"Wmq-Reply": "filtered"},
+		})
+	}
+	result := &DeliveryResult{
+		Code:   fasthttp.StatusUnprocessableEntity,
+		Header: map[string]string{"Wmq-Reply": "dropped"},
+	}
+	if reason != nil {
+		result.Body = []byte(reason.Error())
+	}
+	return sendReply(e, result)
+}
+
+//sendReply publish the response of consumer's url to the reply queue of envelope
+func sendReply(e envelope, result *DeliveryResult) (err error) {
+	r := replyMessage{
+		Code:   result.Code,
+		Header: map[string]string{},
+		Body:   base64.StdEncoding.EncodeToString(result.Body),
+	}
+	for k, v := range result.Header {
+		if ok, _ := inArray(k, replyIgnoreHeaders); !ok {
+			r.Header[k] = v
+		}
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	channel, err := getMqChannel()
+	if err != nil {
+		return
+	}
+	defer channelPools.Put(channel)
+	return channel.Publish("", e.ReplyTo, false, false, amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: e.CorrelationID,
+		Body:          body,
+	})
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+//schemaKeywords is the supported subset of JSON Schema
+var schemaKeywords = map[string]bool{
+	"$schema": true, "title": true, "description": true,
+	"type": true, "enum": true, "required": true, "properties": true, "additionalProperties": true,
+	"items": true, "minItems": true, "maxItems": true,
+	"minLength": true, "maxLength": true, "pattern": true,
+	"minimum": true, "maximum": true,
+}
+
+var schemaTypes = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+//checkSchema check schema is well-formed and only supported keywords are used,
+//compiled patterns are saved in patterns when it's not nil.
+func checkSchema(schema map[string]interface{}, path string, patterns map[string]*regexp.Regexp) error {
+	for k, v := range schema {
+		if !schemaKeywords[k] {
+			return fmt.Errorf("%skeyword [%s] not supported", path, k)
+		}
+		switch k {
+		case "type":
+			var types []interface{}
+			if s, ok := v.(string); ok {
+				types = []interface{}{s}
+			} else if types, ok = v.([]interface{}); !ok {
+				return fmt.Errorf("%stype should be string or array", path)
+			}
+			for _, t := range types {
+				if ok, _ := inArray(t, schemaTypes); !ok {
+					return fmt.Errorf("%stype should be one of %s", path, strings.Join(schemaTypes, ","))
+				}
+			}
+		case "enum", "required":
+			if _, ok := v.([]interface{}); !ok {
+				return fmt.Errorf("%s%s should be array", path, k)
+			}
+		case "properties":
+			props, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%sproperties should be object", path)
+			}
+			for name, p := range props {
+				sub, ok := p.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("%sproperties.%s should be object", path, name)
+				}
+				if err := checkSchema(sub, path+"properties."+name+".", patterns); err != nil {
+					return err
+				}
+			}
+		case "items":
+			sub, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%sitems should be object", path)
+			}
+			if err := checkSchema(sub, path+"items.", patterns); err != nil {
+				return err
+			}
+		case "additionalProperties":
+			if _, ok := v.(bool); !ok {
+				return fmt.Errorf("%sadditionalProperties should be boolean", path)
+			}
+		case "minItems", "maxItems", "minLength", "maxLength", "minimum", "maximum":
+			if _, ok := v.(float64); !ok {
+				return fmt.Errorf("%s%s should be number", path, k)
+			}
+		case "pattern":
+			s, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("%spattern should be string", path)
+			}
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return fmt.Errorf("%spattern %s", path, err)
+			}
+			if patterns != nil {
+				patterns[s] = re
+			}
+		}
+	}
+	return nil
+}
+
+//validateJSON validate data decoded by encoding/json against schema,
+//patterns are compiled by checkSchema,
+//the error point to the invalid field,such as body.items[0].amount
+func validateJSON(schema map[string]interface{}, patterns map[string]*regexp.Regexp, data interface{}, path string) error {
+	if t, ok := schema["type"]; ok && !schemaTypeMatch(t, data) {
+		return fmt.Errorf("%s: should be %v", path, t)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, data) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: should be one of %s", path, jsonString(enum))
+		}
+	}
+	switch d := data.(type) {
+	case map[string]interface{}:
+		required, _ := schema["required"].([]interface{})
+		for _, r := range required {
+			if name, ok := r.(string); ok {
+				if _, ok := d[name]; !ok {
+					return fmt.Errorf("%s.%s: required", path, name)
+				}
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		names := make([]string, 0, len(d))
+		for name := range d {
+			names = append(names, name)
+		}
+		//sorted for stable error message
+		sort.Strings(names)
+		for _, name := range names {
+			sub, ok := props[name].(map[string]interface{})
+			if !ok {
+				if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+					return fmt.Errorf("%s.%s: not allowed", path, name)
+				}
+				continue
+			}
+			if err := validateJSON(sub, patterns, d[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if n, ok := schema["minItems"].(float64); ok && float64(len(d)) < n {
+			return fmt.Errorf("%s: should have at least %v items", path, n)
+		}
+		if n, ok := schema["maxItems"].(float64); ok && float64(len(d)) > n {
+			return fmt.Errorf("%s: should have at most %v items", path, n)
+		}
+		if sub, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range d {
+				if err := validateJSON(sub, patterns, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(d))
+		if n, ok := schema["minLength"].(float64); ok && length < n {
+			return fmt.Errorf("%s: should be at least %v characters", path, n)
+		}
+		if n, ok := schema["maxLength"].(float64); ok && length > n {
+			return fmt.Errorf("%s: should be at most %v characters", path, n)
+		}
+		if p, ok := schema["pattern"].(string); ok && !patterns[p].MatchString(d) {
+			return fmt.Errorf("%s: should match %s", path, p)
+		}
+	case float64:
+		if n, ok := schema["minimum"].(float64); ok && d < n {
+			return fmt.Errorf("%s: should be >= %v", path, n)
+		}
+		if n, ok := schema["maximum"].(float64); ok && d > n {
+			return fmt.Errorf("%s: should be <= %v", path, n)
+		}
+	}
+	return nil
+}
+
+//parseSchema compile patterns of JSONSchema,
+//it's called when message is loaded,added or updated.
+func (m *message) parseSchema() (err error) {
+	m.schemaPatterns = nil
+	if m.JSONSchema == nil {
+		return
+	}
+	patterns := map[string]*regexp.Regexp{}
+	if err = checkSchema(m.JSONSchema, "", patterns); err != nil {
+		return fmt.Errorf("JSONSchema %s", err)
+	}
+	m.schemaPatterns = patterns
+	return
+}
+
+func schemaTypeMatch(t interface{}, data interface{}) bool {
+	types, ok := t.([]interface{})
+	if !ok {
+		types = []interface{}{t}
+	}
+	for _, t := range types {
+		switch d := data.(type) {
+		case map[string]interface{}:
+			ok = t == "object"
+		case []interface{}:
+			ok = t == "array"
+		case string:
+			ok = t == "string"
+		case float64:
+			ok = t == "number" || (t == "integer" && d == math.Trunc(d))
+		case bool:
+			ok = t == "boolean"
+		case nil:
+			ok = t == "null"
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonString(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+)
+
+func mustDecodeJSON(t *testing.T, s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("decode %s fail, %s", s, err)
+	}
+	return v
+}
+
+func TestValidateJSON(t *testing.T) {
+	schema := mustDecodeJSON(t, `{
+		"type": "object",
+		"required": ["id", "items"],
+		"additionalProperties": false,
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"status": {"enum": ["new", "paid"]},
+			"email": {"type": "string", "pattern": "^[^@]+@[^@]+$", "maxLength": 20},
+			"note": {"type": ["string", "null"], "minLength": 2},
+			"items": {
+				"type": "array", "minItems": 1, "maxItems": 2,
+				"items": {"type": "object", "required": ["amount"],
+					"properties": {"amount": {"type": "number", "maximum": 100}}}
+			}
+		}
+	}`).(map[string]interface{})
+	patterns := map[string]*regexp.Regexp{}
+	if err := checkSchema(schema, "", patterns); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"valid", `{"id":1,"items":[{"amount":1.5}]}`, ""},
+		{"valid optional", `{"id":1,"status":"paid","email":"a@b.c","note":null,"items":[{"amount":100}]}`, ""},
+		{"not object", `[]`, "body: should be object"},
+		{"required", `{"items":[{"amount":1}]}`, "body.id: required"},
+		{"integer", `{"id":1.5,"items":[{"amount":1}]}`, "body.id: should be integer"},
+		{"minimum", `{"id":0,"items":[{"amount":1}]}`, "body.id: should be >= 1"},
+		{"enum", `{"id":1,"status":"done","items":[{"amount":1}]}`, `body.status: should be one of ["new","paid"]`},
+		{"pattern", `{"id":1,"email":"ab","items":[{"amount":1}]}`, "body.email: should match ^[^@]+@[^@]+$"},
+		{"max length", `{"id":1,"email":"aaaaaaaaaa@bbbbbbbbbbb","items":[{"amount":1}]}`, "body.email: should be at most 20 characters"},
+		{"type list", `{"id":1,"note":1,"items":[{"amount":1}]}`, "body.note: should be [string null]"},
+		{"min length", `{"id":1,"note":"a","items":[{"amount":1}]}`, "body.note: should be at least 2 characters"},
+		{"min items", `{"id":1,"items":[]}`, "body.items: should have at least 1 items"},
+		{"max items", `{"id":1,"items":[{"amount":1},{"amount":1},{"amount":1}]}`, "body.items: should have at most 2 items"},
+		{"item", `{"id":1,"items":[{"amount":1},{"amount":101}]}`, "body.items[1].amount: should be <= 100"},
+		{"additional", `{"id":1,"items":[{"amount":1}],"extra":true}`, "body.extra: not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateJSON(schema, patterns, mustDecodeJSON(t, tt.data), "body")
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.err {
+				t.Fatalf("err %q, want %q", got, tt.err)
+			}
+		})
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		ok     bool
+	}{
+		{"valid", `{"type":"object","properties":{"a":{"type":"string"}}}`, true},
+		{"unknown keyword", `{"oneOf":[]}`, false},
+		{"unknown type", `{"type":"date"}`, false},
+		{"bad nested", `{"properties":{"a":{"type":1}}}`, false},
+		{"bad items", `{"items":{"minItems":"1"}}`, false},
+		{"bad pattern", `{"pattern":"("}`, false},
+		{"bad additional", `{"additionalProperties":{}}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSchema(mustDecodeJSON(t, tt.schema).(map[string]interface{}), "", nil)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestMessageParseSchema(t *testing.T) {
+	m := message{JSONSchema: mustDecodeJSON(t, `{"properties":{
+		"a":{"pattern":"^a"},
+		"b":{"items":{"pattern":"^b"}},
+		"c":{"pattern":"^a"}}}`).(map[string]interface{})}
+	if err := m.parseSchema(); err != nil {
+		t.Fatal(err)
+	}
+	//patterns are compiled once,publishing reuses them
+	if len(m.schemaPatterns) != 2 || m.schemaPatterns["^a"] == nil || m.schemaPatterns["^b"] == nil {
+		t.Fatalf("patterns %v", m.schemaPatterns)
+	}
+	if err := validateJSON(m.JSONSchema, m.schemaPatterns, mustDecodeJSON(t, `{"a":"ab","b":["bc","c"]}`), "body"); err == nil ||
+		err.Error() != "body.b[1]: should match ^b" {
+		t.Fatalf("err %v", err)
+	}
+	m.JSONSchema = nil
+	if err := m.parseSchema(); err != nil || m.schemaPatterns != nil {
+		t.Fatalf("err %v patterns %v without schema", err, m.schemaPatterns)
+	}
+	m.JSONSchema = map[string]interface{}{"pattern": "("}
+	if err := m.parseSchema(); err == nil {
+		t.Fatal("invalid pattern should fail")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	logger "github.com/snail007/mini-logger"
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	//shutdownChan is closed when wmq begin to shutdown
+	shutdownChan  = make(chan struct{})
+	shutdownLock  = &sync.RWMutex{}
+	isShutdown    bool
+	inflight      = &sync.WaitGroup{}
+	inflightCount int64
+	apiServer     *fasthttp.Server
+	publishServer *fasthttp.Server
+)
+
+//isShuttingDown return true when wmq is shutting down
+func isShuttingDown() bool {
+	shutdownLock.RLock()
+	defer shutdownLock.RUnlock()
+	return isShutdown
+}
+
+//beginDelivery must be called before a delivery is processed,
+//false means wmq is shutting down and the delivery should be requeued.
+func beginDelivery() bool {
+	shutdownLock.RLock()
+	defer shutdownLock.RUnlock()
+	if isShutdown {
+		return false
+	}
+	inflight.Add(1)
+	atomic.AddInt64(&inflightCount, 1)
+	return true
+}
+
+//endDelivery must be called after the delivery was acked or nacked
+func endDelivery() {
+	atomic.AddInt64(&inflightCount, -1)
+	inflight.Done()
+}
+
+//sleepOrShutdown sleep d,but wake up at once when wmq is shutting down
+func sleepOrShutdown(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-shutdownChan:
+	}
+}
+
+//waitForShutdown block until SIGTERM or SIGINT received,and then shutdown wmq
+func waitForShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	ctxFunc("waitForShutdown").Infof("%s received", sig)
+	os.Exit(shutdown(time.Second * time.Duration(cfg.GetInt("consume.ShutdownTimeout"))))
+}
+
+//shutdown stop accepting publishes,stop consumers and wait for in-flight deliveries
+//up to timeout,then release all connections.return the exit code.
+func shutdown(timeout time.Duration) (code int) {
+	ctx := ctxFunc("shutdown")
+	deadline := time.After(timeout)
+	//1.stop accepting publishes and deliveries
+	shutdownLock.Lock()
+	isShutdown = true
+	close(shutdownChan)
+	shutdownLock.Unlock()
+	ctx.Infof("stop accepting publishes and deliveries, waiting up to %s", timeout)
+	//2.wait for in-flight requests and deliveries
+	done := make(chan struct{})
+	go func() {
+		for _, s := range []*fasthttp.Server{publishServer, apiServer} {
+			if s != nil {
+				s.Shutdown()
+			}
+		}
+		inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		ctx.Infof("all in-flight deliveries finished")
+	case <-deadline:
+		code = 1
+		ctx.With(logger.Fields{"inflight": strconv.FormatInt(atomic.LoadInt64(&inflightCount), 10)}).
+			Warnf("timeout, in-flight deliveries will be redelivered by RabbitMQ")
+	}
+	//3.release connections
+	if channelPools != nil {
+		channelPools.ReleaseAll()
+	}
+	if pools != nil {
+		pools.ReleaseAll()
+	}
+	ctx.Infof("WMQ Service Stopped, exit code %d", code)
+	return
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+//consumer worker states
+const (
+	stateConnecting = "connecting"
+	stateConsuming  = "consuming"
+	stateRetrying   = "retrying"
+	statePaused     = "paused"
+	stateStopped    = "stopped"
+
+	//stateCircuitOpen means consuming stopped by circuit breaker
+	stateCircuitOpen = "circuit-open"
+)
+
+//consumerStats is shared by consumer worker and consumer manager,
+//it's kept when consumer was updated.
+type consumerStats struct {
+	lock             *sync.Mutex
+	State            string
+	LastSuccessTime  int64
+	LastFailTime     int64
+	LastError        string
+	LastHTTPCode     int
+	ConsecutiveFails int64
+	Delivered        int64
+	Failed           int64
+	Dropped          int64
+	Filtered         int64
+	//Batches requests sent by batch consumer
+	Batches int64
+	//AvgLatency milliseconds of requests to consumer's URL
+	AvgLatency float64
+	latency    time.Duration
+	requests   int64
+	//Circuit is the state of circuit breaker,empty when it's not set
+	Circuit         string
+	CircuitOpenTime int64
+	CircuitOpens    int64
+	circuitOpenTime time.Time
+	probeDelivered  int64
+	probeFailed     int64
+	//inFlight deliveries of partitions being processed
+	inFlight int64
+	//RateLimit is the rate limit of consumer,Throttled is total requests delayed by it
+	RateLimit  *rateLimit
+	Throttled  int64
+	tokens     float64
+	tokensTime time.Time
+}
+
+func newConsumerStats() *consumerStats {
+	return &consumerStats{
+		lock:  &sync.Mutex{},
+		State: stateConnecting,
+	}
+}
+
+func (s *consumerStats) setState(state string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.State = state
+}
+
+//delivered record n deliveries were processed success in one request
+func (s *consumerStats) delivered(n int64, code int, latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Delivered += n
+	s.LastSuccessTime = time.Now().Unix()
+	s.LastHTTPCode = code
+	s.ConsecutiveFails = 0
+	s.addLatency(latency)
+}
+
+//failed record n deliveries were processed fail in one request
+func (s *consumerStats) failed(n int64, code int, err error, latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Failed += n
+	s.ConsecutiveFails++
+	s.LastFailTime = time.Now().Unix()
+	s.LastHTTPCode = code
+	if err != nil {
+		s.LastError = err.Error()
+	}
+	s.addLatency(latency)
+}
+
+//dropped record a delivery was dropped,such as unsupported message
+func (s *consumerStats) dropped(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Dropped++
+	if err != nil {
+		s.LastError = err.Error()
+	}
+}
+
+//filtered record a delivery didn't match the filter of consumer
+func (s *consumerStats) filtered() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Filtered++
+}
+
+//batched record a batch request was sent
+func (s *consumerStats) batched() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Batches++
+}
+
+func (s *consumerStats) addLatency(latency time.Duration) {
+	s.latency += latency
+	s.requests++
+	s.AvgLatency = float64(s.latency/time.Microsecond) / float64(s.requests) / 1000
+}
+
+//String return stats in json
+func (s *consumerStats) String() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	j, _ := json.Marshal(s)
+	return string(j)
+}
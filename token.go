@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	logger "github.com/snail007/mini-logger"
+)
+
+//defaultTokenLabel is the label of message.Token
+const defaultTokenLabel = "default"
+
+//messageToken is one of the publisher tokens of message,
+//Expire is unix timestamp,0 means never expire.
+type messageToken struct {
+	Label   string
+	Token   string
+	Expire  int64
+	Enabled bool
+}
+
+func (t messageToken) expired() bool {
+	return t.Expire > 0 && t.Expire <= time.Now().Unix()
+}
+
+//masked return copy of t which Token is hidden except the first 4 chars,for output
+func (t messageToken) masked() messageToken {
+	if len(t.Token) > 4 {
+		t.Token = t.Token[:4] + "****"
+	} else {
+		t.Token = "****"
+	}
+	return t
+}
+
+//checkToken return the label of matched token,
+//every token is compared in constant time,so does the whole list.
+func (m *message) checkToken(token string) (label string, ok bool) {
+	if !m.IsNeedToken {
+		return "", true
+	}
+	if m.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(m.Token)) == 1 {
+		label, ok = defaultTokenLabel, true
+	}
+	for _, t := range m.Tokens {
+		matched := subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1
+		if matched && !ok && t.Enabled && !t.expired() {
+			label, ok = t.Label, true
+		}
+	}
+	return
+}
+
+//randomToken generate a token when it's not set on adding
+func randomToken() (token string, err error) {
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	return hex.EncodeToString(b), nil
+}
+
+//parseTokenEnabled parse Enabled arg of token api,1 or true is enabled,0 or false is disabled
+func parseTokenEnabled(s string) (enabled bool, err error) {
+	enabled, err = strconv.ParseBool(s)
+	if err != nil {
+		err = fmt.Errorf("Enabled should be 1 or 0")
+	}
+	return
+}
+
+//getMessageToken return token of message by label
+func getMessageToken(msg *message, label string) (t *messageToken, index int, err error) {
+	for i := range msg.Tokens {
+		if msg.Tokens[i].Label == label {
+			return &msg.Tokens[i], i, nil
+		}
+	}
+	err = errors.New("token not found")
+	return
+}
+
+//addMessageToken add t to tokens of message,the label should not exist
+func addMessageToken(name string, t messageToken) (err error) {
+	return editMessageTokens(name, func(msg *message) error {
+		if _, _, err := getMessageToken(msg, t.Label); err == nil {
+			return errors.New("token exists")
+		}
+		msg.Tokens = append(msg.Tokens, t)
+		return nil
+	})
+}
+
+//updateMessageToken call update with the token of label and return the updated one
+func updateMessageToken(name, label string, update func(t *messageToken)) (t messageToken, err error) {
+	err = editMessageTokens(name, func(msg *message) error {
+		_t, _, err := getMessageToken(msg, label)
+		if err != nil {
+			return err
+		}
+		update(_t)
+		t = *_t
+		return nil
+	})
+	return
+}
+
+//deleteMessageToken remove the token of label from message
+func deleteMessageToken(name, label string) (err error) {
+	return editMessageTokens(name, func(msg *message) error {
+		_, i, err := getMessageToken(msg, label)
+		if err != nil {
+			return err
+		}
+		msg.Tokens = append(msg.Tokens[:i], msg.Tokens[i+1:]...)
+		return nil
+	})
+}
+
+//editMessageTokens call edit with a copy of message under msgLock and replace tokens of message,
+//so concurrent edits are not lost,consumers are not affected
+func editMessageTokens(name string, edit func(msg *message) error) (err error) {
+	ctx := ctxFunc("editMessageTokens").With(logger.Fields{"message": name})
+	msgLock.Lock()
+	defer msgLock.Unlock()
+	msg, i, err := getMessage(name)
+	if err != nil {
+		return
+	}
+	msg.Tokens = append([]messageToken{}, msg.Tokens...)
+	if err = edit(msg); err != nil {
+		return
+	}
+	if err = validateMessage(*msg).err(); err != nil {
+		return
+	}
+	messages[i].Tokens = msg.Tokens
+	ctx.Infof("tokens updated")
+	return
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckToken(t *testing.T) {
+	past, future := time.Now().Add(-time.Hour).Unix(), time.Now().Add(time.Hour).Unix()
+	m := &message{
+		IsNeedToken: true,
+		Token:       "default-token",
+		Tokens: []messageToken{
+			{Label: "ci", Token: "ci-token", Enabled: true},
+			{Label: "partner", Token: "partner-token", Expire: future, Enabled: true},
+			{Label: "old", Token: "old-token", Expire: past, Enabled: true},
+			{Label: "off", Token: "off-token", Enabled: false},
+			{Label: "dup", Token: "default-token", Enabled: true},
+		},
+	}
+	tests := []struct {
+		name  string
+		token string
+		label string
+		ok    bool
+	}{
+		{"default", "default-token", defaultTokenLabel, true},
+		{"label", "ci-token", "ci", true},
+		{"not expired", "partner-token", "partner", true},
+		{"expired", "old-token", "", false},
+		{"disabled", "off-token", "", false},
+		{"unknown", "unknown", "", false},
+		{"empty", "", "", false},
+		{"prefix", "ci-toke", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			label, ok := m.checkToken(tt.token)
+			if label != tt.label || ok != tt.ok {
+				t.Fatalf("checkToken %q,%v, want %q,%v", label, ok, tt.label, tt.ok)
+			}
+		})
+	}
+	t.Run("token not needed", func(t *testing.T) {
+		if _, ok := (&message{Token: "x"}).checkToken(""); !ok {
+			t.Fatal("token should not be checked")
+		}
+	})
+	t.Run("empty default token", func(t *testing.T) {
+		if _, ok := (&message{IsNeedToken: true}).checkToken(""); ok {
+			t.Fatal("empty token should not match empty Token")
+		}
+	})
+}
+
+func TestMaskedToken(t *testing.T) {
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{"abcdefgh", "abcd****"},
+		{"abcd", "****"},
+		{"", "****"},
+	}
+	for _, tt := range tests {
+		if got := (messageToken{Token: tt.token}).masked().Token; got != tt.want {
+			t.Fatalf("masked %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestParseTokenEnabled(t *testing.T) {
+	tests := []struct {
+		s       string
+		enabled bool
+		ok      bool
+	}{
+		{"1", true, true},
+		{"true", true, true},
+		{"0", false, true},
+		{"false", false, true},
+		{"", false, false},
+		{"yes", false, false},
+	}
+	for _, tt := range tests {
+		enabled, err := parseTokenEnabled(tt.s)
+		if (err == nil) != tt.ok || enabled != tt.enabled {
+			t.Fatalf("%q enabled %v err %v, want %v ok %v", tt.s, enabled, err, tt.enabled, tt.ok)
+		}
+	}
+}
+
+func TestEditMessageTokens(t *testing.T) {
+	old := messages
+	defer func() { messages = old }()
+	messages = []message{{Name: "tokens", Mode: "topic", IsNeedToken: true}}
+	//concurrent adds should not lose tokens
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := addMessageToken("tokens", messageToken{Label: "l" + strconv.Itoa(i), Token: "t" + strconv.Itoa(i), Enabled: true}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := len(messages[0].Tokens); n != 20 {
+		t.Fatalf("%d tokens, want 20", n)
+	}
+	steps := []struct {
+		name string
+		do   func() error
+		ok   bool
+	}{
+		{"add exists", func() error { return addMessageToken("tokens", messageToken{Label: "l1", Token: "x"}) }, false},
+		{"add to missing message", func() error { return addMessageToken("missing", messageToken{Label: "l1", Token: "x"}) }, false},
+		{"update", func() error {
+			_, err := updateMessageToken("tokens", "l1", func(t *messageToken) { t.Enabled = false })
+			return err
+		}, true},
+		{"update missing", func() error {
+			_, err := updateMessageToken("tokens", "missing", func(t *messageToken) {})
+			return err
+		}, false},
+		{"delete", func() error { return deleteMessageToken("tokens", "l2") }, true},
+		{"delete missing", func() error { return deleteMessageToken("tokens", "l2") }, false},
+	}
+	for _, step := range steps {
+		if err := step.do(); (err == nil) != step.ok {
+			t.Fatalf("%s: err %v, want ok %v", step.name, err, step.ok)
+		}
+	}
+	m := messages[0]
+	if _, ok := m.checkToken("t1"); ok || len(m.Tokens) != 19 {
+		t.Fatalf("disabled token is accepted or %d tokens", len(m.Tokens))
+	}
+	if _, ok := m.checkToken("t3"); !ok {
+		t.Fatal("token t3 should be kept")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/Jeffail/gabs"
+	"github.com/valyala/fasthttp"
+)
+
+//transform rewrite the request to consumer's url,every field is a text/template,
+//empty field means unchanged,header rendered to empty is removed.
+type transform struct {
+	URL     string
+	Method  string
+	Headers map[string]string
+	Body    string
+}
+
+//envelope is the message published to RabbitMQ by apiPublish
+type envelope struct {
+	Body       string
+	Header     map[string]string
+	IP         string
+	Method     string
+	Args       string
+	TokenLabel string
+	//ReplyTo is set when the publisher is waiting for the response of ReplyConsumer
+	ReplyTo       string
+	CorrelationID string
+	ReplyConsumer string
+}
+
+var (
+	//templateCache compiled templates of consumers,templates being checked are not cached
+	templateCache = newLRUCache(compiledCacheSize)
+	templateFuncs = template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"base64": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		"urlquery": url.QueryEscape,
+		"upper":    strings.ToUpper,
+		"lower":    strings.ToLower,
+		"default": func(d, v interface{}) interface{} {
+			if v == nil || v == "" {
+				return d
+			}
+			return v
+		},
+	}
+)
+
+//parseEnvelope parse content from RabbitMQ,body is decoded
+func parseEnvelope(content string) (e envelope, err error) {
+	jsonParsed, err := gabs.ParseJSON([]byte(content))
+	if err != nil {
+		return
+	}
+	if !jsonParsed.Exists("body") || !jsonParsed.Exists("header") ||
+		!jsonParsed.Exists("ip") || !jsonParsed.Exists("method") || !jsonParsed.Exists("args") {
+		err = errors.New("message not supported")
+		return
+	}
+	body, _ := jsonParsed.S("body").Data().(string)
+	e.IP, _ = jsonParsed.S("ip").Data().(string)
+	e.Args, _ = jsonParsed.S("args").Data().(string)
+	e.Method, _ = jsonParsed.S("method").Data().(string)
+	e.TokenLabel, _ = jsonParsed.S("tokenLabel").Data().(string)
+	e.ReplyTo, _ = jsonParsed.S("replyTo").Data().(string)
+	e.CorrelationID, _ = jsonParsed.S("correlationId").Data().(string)
+	e.ReplyConsumer, _ = jsonParsed.S("replyConsumer").Data().(string)
+	//header is a json string set by apiPublish
+	e.Header = map[string]string{}
+	if header, ok := jsonParsed.S("header").Data().(string); ok {
+		err = json.Unmarshal([]byte(header), &e.Header)
+	} else {
+		header, _ := jsonParsed.S("header").ChildrenMap()
+		for k, child := range header {
+			e.Header[k], _ = child.Data().(string)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("decode header fail,%s", err)
+		return
+	}
+	decodeBytes, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		err = fmt.Errorf("decode body fail,%s", err)
+		return
+	}
+	e.Body = string(decodeBytes)
+	return
+}
+
+//templateData is the data of transform templates,
+//JSON is the body decoded as json,nil when body is not json.
+func (e envelope) templateData(c consumer) map[string]interface{} {
+	var body interface{}
+	json.Unmarshal([]byte(e.Body), &body)
+	query, _ := url.ParseQuery(e.Args)
+	return map[string]interface{}{
+		"Body":       e.Body,
+		"JSON":       body,
+		"Header":     e.Header,
+		"Query":      query,
+		"Args":       e.Args,
+		"IP":         e.IP,
+		"Method":     e.Method,
+		"TokenLabel": e.TokenLabel,
+		"URL":        c.URL,
+		"ConsumerID": c.ID,
+	}
+}
+
+func parseTemplate(text string) (t *template.Template, err error) {
+	return template.New("transform").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+//compileTemplate return the cached template of text,it's parsed when it's not cached
+func compileTemplate(text string) (t *template.Template, err error) {
+	if v, ok := templateCache.get(text); ok {
+		return v.(*template.Template), nil
+	}
+	if t, err = parseTemplate(text); err != nil {
+		return
+	}
+	templateCache.add(text, t)
+	return
+}
+
+func renderTemplate(field, text string, data interface{}) (s string, err error) {
+	t, err := compileTemplate(text)
+	if err != nil {
+		return "", fmt.Errorf("transform %s: %s", field, err)
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("transform %s: %s", field, err)
+	}
+	return buf.String(), nil
+}
+
+//check parse every template of t
+func (t *transform) check() error {
+	fields := map[string]string{"URL": t.URL, "Method": t.Method, "Body": t.Body}
+	for k, v := range t.Headers {
+		fields["Headers."+k] = v
+	}
+	for field, text := range fields {
+		if _, err := parseTemplate(text); err != nil {
+			return fmt.Errorf("%s: %s", field, err)
+		}
+	}
+	return nil
+}
+
+//newConsumerRequest build the request to consumer's url from envelope,
+//the transform of consumer is applied when it's set.
+func newConsumerRequest(e envelope, c consumer) (req *fasthttp.Request, err error) {
+	URL := c.URL
+	if e.Args != "" {
+		if strings.Contains(c.URL, "?") {
+			URL = c.URL + "&" + e.Args
+		} else {
+			URL = c.URL + "?" + e.Args
+		}
+	}
+	method := strings.ToUpper(e.Method)
+	body := ""
+	if method == "POST" {
+		body = e.Body
+	}
+	header := map[string]string{}
+	for k, v := range e.Header {
+		header[k] = v
+	}
+	header[cfg.GetString("publish.RealIpHeader")] = e.IP
+	if t := c.Transform; t != nil {
+		data := e.templateData(c)
+		if t.URL != "" {
+			if URL, err = renderTemplate("URL", t.URL, data); err != nil {
+				return
+			}
+		}
+		if t.Method != "" {
+			if method, err = renderTemplate("Method", t.Method, data); err != nil {
+				return
+			}
+			method = strings.ToUpper(strings.TrimSpace(method))
+		}
+		if t.Body != "" {
+			if body, err = renderTemplate("Body", t.Body, data); err != nil {
+				return
+			}
+		}
+		for k, text := range t.Headers {
+			var v string
+			if v, err = renderTemplate("Headers."+k, text, data); err != nil {
+				return
+			}
+			if v == "" {
+				delete(header, k)
+			} else {
+				header[k] = v
+			}
+		}
+	}
+	req = &fasthttp.Request{}
+	req.SetRequestURI(URL)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	req.Header.SetUserAgent("wmq v" + cfg.GetString("wmq.version") + " - https://github.com/snail007/wmq")
+	req.Header.SetMethod(method)
+	if body != "" {
+		req.SetBodyString(body)
+	}
+	return
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 
 	logger "github.com/snail007/mini-logger"
 )
@@ -48,6 +49,15 @@ func inArray(val interface{}, array interface{}) (exists bool, index int) {
 
 	return
 }
+//splitList split s by comma,items are trimmed and empty ones are dropped
+func splitList(s string) (list []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return
+}
 func pathExists(_path string) bool {
 	_, err := os.Stat(_path)
 	if err != nil && os.IsNotExist(err) {
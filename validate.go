@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	messageNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_\-.]+$`)
+	messageModes      = []string{"fanout", "topic", "direct", "headers"}
+)
+
+type fieldError struct {
+	Field string
+	Error string
+}
+
+//validationErrors is returned by validateXXX,every item point to one field
+type validationErrors []fieldError
+
+func (e validationErrors) Error() string {
+	var s []string
+	for _, f := range e {
+		s = append(s, f.Field+": "+f.Error)
+	}
+	return "validate fail, " + strings.Join(s, "; ")
+}
+
+//err return nil when there is no error,avoid typed nil error
+func (e validationErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *validationErrors) add(field, format string, args ...interface{}) {
+	*e = append(*e, fieldError{Field: field, Error: fmt.Sprintf(format, args...)})
+}
+
+//validateMessages check all messages,such as loaded from data file
+func validateMessages(messages0 []message) (err error) {
+	var errs validationErrors
+	names := map[string]bool{}
+	for i, m := range messages0 {
+		prefix := fmt.Sprintf("[%d].", i)
+		if m.Name != "" && names[m.Name] {
+			errs.add(prefix+"Name", "message [%s] duplicated", m.Name)
+		}
+		names[m.Name] = true
+		for j, b := range m.Bindings {
+			if findMessage(messages0, b.To) == nil {
+				errs.add(fmt.Sprintf("%sBindings[%d].To", prefix, j), "message [%s] not found", b.To)
+			}
+		}
+		for _, e := range validateMessage(m) {
+			errs.add(prefix+e.Field, "%s", e.Error)
+		}
+	}
+	return errs.err()
+}
+
+//validateMessage check message and it's consumers
+func validateMessage(m message) (errs validationErrors) {
+	if m.Name == "" {
+		errs.add("Name", "required")
+	} else if !messageNameRegexp.MatchString(m.Name) {
+		errs.add("Name", "only letters,digits and _-. are allowed")
+	}
+	if ok, _ := inArray(m.Mode, messageModes); !ok {
+		errs.add("Mode", "should be one of %s", strings.Join(messageModes, ","))
+	}
+	if m.IsNeedToken && m.Token == "" && len(m.Tokens) == 0 {
+		errs.add("Token", "Token or Tokens required when IsNeedToken is true")
+	}
+	if m.MaxBodyBytes < 0 {
+		errs.add("MaxBodyBytes", "should not be less than 0")
+	}
+	if m.IdempotencyWindow < 0 {
+		errs.add("IdempotencyWindow", "should not be less than 0")
+	}
+	if m.MaxPriority < 0 || m.MaxPriority > maxPriority {
+		errs.add("MaxPriority", "should be between 0 and %d", maxPriority)
+	}
+	for _, t := range m.ContentTypes {
+		if _, _, e := mime.ParseMediaType(t); e != nil {
+			errs.add("ContentTypes", "[%s] %s", t, e)
+		}
+	}
+	if m.JSONSchema != nil {
+		if e := checkSchema(m.JSONSchema, "", nil); e != nil {
+			errs.add("JSONSchema", "%s", e)
+		}
+	}
+	for i, b := range m.Bindings {
+		prefix := fmt.Sprintf("Bindings[%d].", i)
+		if b.To == "" {
+			errs.add(prefix+"To", "required")
+		} else if b.To == m.Name {
+			errs.add(prefix+"To", "should not be the message itself")
+		}
+		if findBinding(m.Bindings[:i], b) >= 0 {
+			errs.add(prefix+"To", "binding duplicated")
+		}
+		if e := checkRouteKey(m.Mode, b.RouteKey); e != "" {
+			errs.add(prefix+"RouteKey", "%s", e)
+		}
+	}
+	if m.ReplyConsumer != "" {
+		if c := findConsumer(m.Consumers, m.ReplyConsumer); c == nil {
+			errs.add("ReplyConsumer", "consumer [%s] not found", m.ReplyConsumer)
+		} else if c.Batch != nil {
+			errs.add("ReplyConsumer", "consumer [%s] is in batch mode", m.ReplyConsumer)
+		}
+	}
+	labels := map[string]bool{defaultTokenLabel: true}
+	for i, t := range m.Tokens {
+		prefix := fmt.Sprintf("Tokens[%d].", i)
+		if t.Label == "" {
+			errs.add(prefix+"Label", "required")
+		} else if labels[t.Label] {
+			errs.add(prefix+"Label", "label [%s] duplicated or reserved", t.Label)
+		}
+		labels[t.Label] = true
+		if t.Token == "" {
+			errs.add(prefix+"Token", "required")
+		}
+		if t.Expire < 0 {
+			errs.add(prefix+"Expire", "should be unix timestamp or 0")
+		}
+	}
+	if _, e := parseCIDRs(m.AllowIPs); e != nil {
+		errs.add("AllowIPs", "%s", e)
+	}
+	if _, e := parseCIDRs(m.DenyIPs); e != nil {
+		errs.add("DenyIPs", "%s", e)
+	}
+	ids := map[string]bool{}
+	for i, c := range m.Consumers {
+		prefix := fmt.Sprintf("Consumers[%d].", i)
+		if c.ID != "" && ids[c.ID] {
+			errs.add(prefix+"ID", "consumer [%s] duplicated", c.ID)
+		}
+		ids[c.ID] = true
+		for _, e := range validateConsumer(m, c) {
+			errs.add(prefix+e.Field, "%s", e.Error)
+		}
+	}
+	return
+}
+
+//validateConsumer check consumer,m is the message which consumer belongs to
+func validateConsumer(m message, c consumer) (errs validationErrors) {
+	if c.ID == "" {
+		errs.add("ID", "required")
+	}
+	if c.URL == "" {
+		errs.add("URL", "required")
+	} else if d, u, e := getDeliverer(c.URL); e != nil {
+		errs.add("URL", "%s", e)
+	} else if e = d.Check(u); e != nil {
+		errs.add("URL", "%s", e)
+	}
+	if c.Timeout <= 0 {
+		errs.add("Timeout", "should be greater than 0")
+	}
+	if c.CheckCode && (c.Code < 100 || c.Code > 599 || c.Code != float64(int(c.Code))) {
+		errs.add("Code", "should be a http code between 100 and 599")
+	}
+	if e := checkRouteKey(m.Mode, c.RouteKey); e != "" {
+		errs.add("RouteKey", "%s", e)
+	}
+	if m.Mode == "headers" {
+		if c.HeadersMatch == nil || len(c.HeadersMatch.Headers) == 0 {
+			errs.add("HeadersMatch", "headers required when mode is headers")
+		} else if ok, _ := inArray(c.HeadersMatch.XMatch, []string{"", "all", "any"}); !ok {
+			errs.add("HeadersMatch.XMatch", "should be one of all,any")
+		}
+	} else if c.HeadersMatch != nil {
+		errs.add("HeadersMatch", "only allowed when mode is headers")
+	}
+	if _, e := parseFilter(c.Filter); c.Filter != "" && e != nil {
+		errs.add("Filter", "%s", e)
+	}
+	if c.Transform != nil {
+		if e := c.Transform.check(); e != nil {
+			errs.add("Transform", "%s", e)
+		}
+	}
+	if c.Batch != nil {
+		if e := c.Batch.check(); e != nil {
+			errs.add("Batch", "%s", e)
+		}
+		//one request is sent for many deliveries,only Body is applied to every item
+		if t := c.Transform; t != nil && (t.URL != "" || t.Method != "" || len(t.Headers) > 0) {
+			errs.add("Transform", "only Body is allowed in batch mode")
+		}
+	}
+	if c.RateLimit != nil {
+		if e := c.RateLimit.check(); e != nil {
+			errs.add("RateLimit", "%s", e)
+		}
+	}
+	if c.CircuitBreaker != nil {
+		if e := c.CircuitBreaker.check(); e != nil {
+			errs.add("CircuitBreaker", "%s", e)
+		}
+	}
+	if c.Partition != nil {
+		if e := c.Partition.check(); e != nil {
+			errs.add("Partition", "%s", e)
+		}
+		if c.Batch != nil {
+			errs.add("Partition", "not allowed in batch mode")
+		}
+	}
+	return
+}
+
+//checkRouteKey return the reason why routeKey is malformed,empty string means ok
+func checkRouteKey(mode, routeKey string) string {
+	if len(routeKey) > 255 {
+		return "should not be longer than 255 bytes"
+	}
+	if mode != "topic" || routeKey == "" {
+		return ""
+	}
+	for _, word := range strings.Split(routeKey, ".") {
+		if word == "" {
+			return "empty word is not allowed in topic route key"
+		}
+		if word != "*" && word != "#" && strings.ContainsAny(word, "*#") {
+			return "wildcard * and # should be a whole word"
+		}
+	}
+	return ""
+}
+
+//validateCommand `wmq validate <file>` check a data file offline,return exit code
+func validateCommand(args []string) int {
+	if len(args) != 1 {
+		fmt.Println("usage: wmq validate <file>")
+		return 2
+	}
+	content, err := fileGetContents(args[0])
+	if err == nil {
+		_, err = parseMessages(content)
+	}
+	if err == nil {
+		fmt.Printf("%s is valid\n", args[0])
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "%s is invalid\n", args[0])
+	if errs, ok := err.(validationErrors); ok {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", e.Field, e.Error)
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "  %s\n", err)
+	}
+	return 1
+}
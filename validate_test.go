@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateConsumer(t *testing.T) {
+	topic := message{Name: "orders", Mode: "topic"}
+	headers := message{Name: "orders", Mode: "headers"}
+	valid := func() consumer {
+		return consumer{ID: "c1", URL: "http://127.0.0.1/wmq", RouteKey: "order.#", Timeout: 5000, Code: 200, CheckCode: true}
+	}
+	tests := []struct {
+		name   string
+		m      message
+		c      func(c *consumer)
+		fields []string
+	}{
+		{"valid", topic, func(c *consumer) {}, nil},
+		{"id required", topic, func(c *consumer) { c.ID = "" }, []string{"ID"}},
+		{"url required", topic, func(c *consumer) { c.URL = "" }, []string{"URL"}},
+		{"scheme not allowed", topic, func(c *consumer) { c.URL = "ftp://127.0.0.1/" }, []string{"URL"}},
+		{"tcp without port", topic, func(c *consumer) { c.URL = "tcp://127.0.0.1" }, []string{"URL"}},
+		{"file not absolute", topic, func(c *consumer) { c.URL = "file://log/a.log" }, []string{"URL"}},
+		{"timeout", topic, func(c *consumer) { c.Timeout = 0 }, []string{"Timeout"}},
+		{"code", topic, func(c *consumer) { c.Code = 600 }, []string{"Code"}},
+		{"code not checked", topic, func(c *consumer) { c.Code, c.CheckCode = 0, false }, nil},
+		{"empty topic word", topic, func(c *consumer) { c.RouteKey = "order..paid" }, []string{"RouteKey"}},
+		{"partial wildcard", topic, func(c *consumer) { c.RouteKey = "order.pa*" }, []string{"RouteKey"}},
+		{"headers required", headers, func(c *consumer) {}, []string{"HeadersMatch"}},
+		{"headers match", headers, func(c *consumer) {
+			c.HeadersMatch = &headersMatch{XMatch: "any", Headers: map[string]string{"X-Region": "eu"}}
+		}, nil},
+		{"headers x-match", headers, func(c *consumer) {
+			c.HeadersMatch = &headersMatch{XMatch: "some", Headers: map[string]string{"X-Region": "eu"}}
+		}, []string{"HeadersMatch.XMatch"}},
+		{"headers match of topic", topic, func(c *consumer) {
+			c.HeadersMatch = &headersMatch{Headers: map[string]string{"X-Region": "eu"}}
+		}, []string{"HeadersMatch"}},
+		{"filter", topic, func(c *consumer) { c.Filter = "body.amount >" }, []string{"Filter"}},
+		{"transform", topic, func(c *consumer) { c.Transform = &transform{Body: "{{.Body"} }, []string{"Transform"}},
+		{"batch", topic, func(c *consumer) { c.Batch = &batch{MaxItems: 0, MaxWait: 100} }, []string{"Batch"}},
+		{"batch transform url", topic, func(c *consumer) {
+			c.Batch = &batch{MaxItems: 10, MaxWait: 100}
+			c.Transform = &transform{URL: "http://127.0.0.1/batch"}
+		}, []string{"Transform"}},
+		{"rate limit", topic, func(c *consumer) { c.RateLimit = &rateLimit{Rate: 0} }, []string{"RateLimit"}},
+		{"circuit breaker", topic, func(c *consumer) { c.CircuitBreaker = &circuitBreaker{} }, []string{"CircuitBreaker"}},
+		{"partition with batch", topic, func(c *consumer) {
+			c.Batch = &batch{MaxItems: 10, MaxWait: 100}
+			c.Partition = &partition{Key: "body.id", Concurrency: 2}
+		}, []string{"Partition"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.c(&c)
+			errs := validateConsumer(tt.m, c)
+			var fields []string
+			for _, e := range errs {
+				fields = append(fields, e.Field)
+			}
+			if len(fields) != len(tt.fields) {
+				t.Fatalf("fields %v, want %v, %v", fields, tt.fields, errs)
+			}
+			for i := range fields {
+				if fields[i] != tt.fields[i] {
+					t.Fatalf("fields %v, want %v", fields, tt.fields)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateMessages(t *testing.T) {
+	c := consumer{ID: "c1", URL: "http://127.0.0.1/wmq", Timeout: 5000}
+	tests := []struct {
+		name     string
+		messages []message
+		ok       bool
+	}{
+		{"valid", []message{{Name: "a", Mode: "topic", Consumers: []consumer{c}}}, true},
+		{"duplicated message", []message{{Name: "a", Mode: "topic"}, {Name: "a", Mode: "topic"}}, false},
+		{"duplicated consumer", []message{{Name: "a", Mode: "topic", Consumers: []consumer{c, c}}}, false},
+		{"bad name", []message{{Name: "a b", Mode: "topic"}}, false},
+		{"bad mode", []message{{Name: "a", Mode: "round"}}, false},
+		{"binding to missing message", []message{{Name: "a", Mode: "topic",
+			Bindings: []messageBinding{{To: "b", RouteKey: "#"}}}}, false},
+		{"binding", []message{{Name: "a", Mode: "topic", Bindings: []messageBinding{{To: "b", RouteKey: "#"}}},
+			{Name: "b", Mode: "topic"}}, true},
+		{"bad allow ip", []message{{Name: "a", Mode: "topic", AllowIPs: []string{"10.0.0.300"}}}, false},
+		{"max priority", []message{{Name: "a", Mode: "topic", MaxPriority: 256}}, false},
+		{"reply consumer not found", []message{{Name: "a", Mode: "topic", ReplyConsumer: "c2",
+			Consumers: []consumer{c}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMessages(tt.messages)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
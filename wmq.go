@@ -17,10 +17,10 @@ const (
 )
 
 var (
-	uri                            = ""
 	mqHeartbeat                    = time.Second * 2
 	mqConnectionAndDeadlineTimeout = time.Second * 4
 	mqConnectionFailRetrySleep     = time.Second * 3
+	mqReconnectMaxWait             = time.Second * 60
 	messageDataFilePath            = ""
 	messages                       = []message{}
 )
@@ -29,6 +29,7 @@ func panicHandler(output string) {
 	fmt.Println("called" + output)
 }
 func main() {
+	setup()
 	ctx := log.With(logger.Fields{"func": "main"})
 
 	ctx.Info("WMQ Service Started")
@@ -38,18 +39,46 @@ func main() {
 		ctx.With(logger.Fields{"call": "initMessages()"}).Fatalln("%s", err)
 	}
 
+	if cfg.GetBool("consume.WatchDataFile") {
+		if err := watchDataFile(messageDataFilePath); err != nil {
+			ctx.With(logger.Fields{"call": "watchDataFile()"}).Warnf("%s", err)
+		}
+	}
+
 	if !cfg.GetBool("api-disable") {
 		//init api service
-		go serveAPI(cfg.GetString("listen.api"), cfg.GetString("api.token"))
+		apiTLS, err := listenerTLS("api", true)
+		if err != nil {
+			ctx.With(logger.Fields{"call": "listenerTLS(api)"}).Fatalln("%s", err)
+		}
+		//servers are created before serving,shutdown reads them
+		apiServer = newAPIServer(cfg.GetString("api.token"))
+		go serveAPI(apiServer, cfg.GetString("listen.api"), apiTLS)
 	}
 
+	//receive replies for publishing with header Reply: wait
+	go consumeReplies()
+
 	//init publish service
-	go servePublish(cfg.GetString("listen.publish"))
+	publishTLS, err := listenerTLS("publish", false)
+	if err != nil {
+		ctx.With(logger.Fields{"call": "listenerTLS(publish)"}).Fatalln("%s", err)
+	}
+	publishServer = newPublishServer()
+	go servePublish(publishServer, cfg.GetString("listen.publish"), publishTLS)
 
-	select {}
+	if len(certReloaders) > 0 {
+		if err := watchCerts(); err != nil {
+			ctx.With(logger.Fields{"call": "watchCerts()"}).Warnf("%s", err)
+		}
+	}
+
+	waitForShutdown()
 }
 
-func init() {
+//setup load config,connect to RabbitMQ and load data file,
+//it's not init(),so tests can run without them
+func setup() {
 	fmt.Println(poster())
 	var err error
 
@@ -62,21 +91,23 @@ func init() {
 	initLog()
 
 	ctx := log.With(logger.Fields{"func": "init"})
-	vhost := cfg.GetString("rabbitmq.vhost")
-	if vhost != "/" {
-		vhost = "/" + vhost
+	if err = initMqTLS(); err != nil {
+		ctx.Safe().Fatalf("init rabbitmq tls fail : %s", err)
+	}
+	if err = initNodes(); err != nil {
+		ctx.Safe().Fatalf("init rabbitmq nodes fail : %s", err)
+	}
+	if err = initIPFilter(); err != nil {
+		ctx.Safe().Fatalf("init ip filter fail : %s", err)
 	}
-	uri = fmt.Sprintf("amqp://%s:%s@%s:%d%s",
-		cfg.GetString("rabbitmq.username"),
-		cfg.GetString("rabbitmq.password"),
-		cfg.GetString("rabbitmq.host"),
-		cfg.GetInt("rabbitmq.port"),
-		vhost)
 	messageDataFilePath = cfg.GetString("consume.DataFile")
 	messages, err = loadMessagesFromFile(messageDataFilePath)
 	if err != nil {
 		ctx.Safe().Fatalf("load message data form file fail [%s],%s", messageDataFilePath, err)
 	}
+	if err = initIdempotency(); err != nil {
+		ctx.Safe().Fatalf("init idempotency store fail : %s", err)
+	}
 	if err = initPool(); err != nil {
 		ctx.Safe().Fatalf("init connection to rabbitmq fail : %s", err)
 
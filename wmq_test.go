@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	logger "github.com/snail007/mini-logger"
+)
+
+//TestMain set up what setup() does for tests,without config file and RabbitMQ
+func TestMain(m *testing.M) {
+	log = logger.New(false, nil)
+	accessLog = logger.New(false, nil)
+	cfg.Set("consume.Schemes", []string{"http", "https", "tcp", "exec", "file", "grpc", "grpcs"})
+	cfg.Set("consume.FailWait", 1)
+	cfg.Set("consume.GoFailWait", 1)
+	initConsumerManager()
+	//wait for the manager reading config,tests set config later
+	statusConsumerWorker(consumer{}, message{})
+	os.Exit(m.Run())
+}